@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/iglov/netbox-agent/lib/config"
+	"github.com/netbox-community/go-netbox/v4"
+)
+
+// newClient creates the NetBox API client of a target, its requests are counted in the metrics and carry the current token
+func newClient(cfg *config.Config, target string) (*netbox.APIClient, error) {
+	transport, err := netboxTransport(cfg.NetBox)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := newTokenSource(cfg.NetBox)
+	if err != nil {
+		return nil, err
+	}
+
+	clientCfg := netbox.NewConfiguration()
+	clientCfg.Servers[0].URL = cfg.NetBox.URL
+	for name, value := range cfg.NetBox.Headers {
+		clientCfg.AddDefaultHeader(name, value)
+	}
+	clientCfg.HTTPClient = &http.Client{
+		Timeout:   time.Duration(cfg.NetBox.Timeout),
+		Transport: tokenTransport{source: tokens, next: apiTransport{target: target, next: transport}},
+	}
+
+	return netbox.NewAPIClient(clientCfg), nil
+}
+
+// netboxTransport applies the TLS and proxy settings of the NetBox connection
+func netboxTransport(cfg config.NetBoxConfig) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	tlsConfig := &tls.Config{MinVersion: config.TLSVersions[cfg.TLSMinVersion]}
+
+	if cfg.CAFile != "" {
+		ca, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", cfg.CAFile, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates in %s", cfg.CAFile)
+		}
+	}
+
+	if cfg.TLSCert != "" {
+		pair, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading NetBox client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+
+	if cfg.InsecureSkipVerify {
+		log.Warn("!!! netbox.insecure_skip_verify is enabled, the NetBox certificate is NOT verified. " +
+			"Anyone on the network path can read the API token and change the inventory. Do not use this in production. !!!")
+		tlsConfig.InsecureSkipVerify = true
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	switch cfg.Proxy {
+	case "env":
+		transport.Proxy = http.ProxyFromEnvironment
+	case "none":
+		transport.Proxy = nil
+	default:
+		proxy, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %s: %v", cfg.Proxy, err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	return transport, nil
+}
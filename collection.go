@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/iglov/netbox-agent/lib/collector"
+	"github.com/iglov/netbox-agent/lib/config"
+	"github.com/iglov/netbox-agent/lib/plugins"
+	"github.com/sirupsen/logrus"
+)
+
+// Status of a collector in collection_errors
+const (
+	collectorOK       = "ok"
+	collectorFailed   = "failed"
+	collectorTimedOut = "timed_out"
+	collectorSkipped  = "skipped"
+)
+
+// collectorStatus is the outcome of a collector, the inventory is complete only if every status is ok or skipped
+type collectorStatus struct {
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// failed reports whether the collector ran without result
+func (c collectorStatus) failed() bool {
+	return c.Status == collectorFailed || c.Status == collectorTimedOut
+}
+
+// collectorFailed reports whether the collector ran and failed, its part of the inventory is missing
+func (f *FullSystemInfo) collectorFailed(name string) bool {
+	return f.CollectionErrors[name].failed()
+}
+
+// collectorSkipped reports whether the collector found nothing to collect
+func (f *FullSystemInfo) collectorSkipped(name string) bool {
+	return f.CollectionErrors[name].Status == collectorSkipped
+}
+
+// collectorGrace is how long a collector that timed out has to clean up before it is left behind
+const collectorGrace = 2 * time.Second
+
+// errCollectorTimeout is the error of a collector that didn't finish within collectors.timeout
+var errCollectorTimeout = errors.New("timed out")
+
+// collection runs the collectors of one collect in parallel and records their status
+type collection struct {
+	cfg *config.Config
+	wg  sync.WaitGroup
+
+	// mu guards statuses and results
+	mu       sync.Mutex
+	statuses map[string]collectorStatus
+	results  map[string]interface{}
+}
+
+// collect runs the registered collectors that are enabled in parallel.
+// A failed collector is recorded in collection_errors and the others go on, only the system information is required.
+func collect(cfg *config.Config) (FullSystemInfo, error) {
+	start := time.Now()
+	c := &collection{cfg: cfg, statuses: map[string]collectorStatus{}, results: map[string]interface{}{}}
+
+	// Collectors of the same source share what they read, e.g. the SMBIOS table
+	ctx := collector.WithCache(context.Background())
+
+	collectors := collector.All()
+	found, errs := plugins.Find(cfg.Collectors.PluginDir)
+	for _, err := range errs {
+		log.Warn(err)
+	}
+	for _, plugin := range found {
+		if isRegistered(collectors, plugin.Name()) {
+			log.Warnf("Skipping plugin %s, a collector of that name exists", plugin.Name())
+			continue
+		}
+		collectors = append(collectors, plugin)
+	}
+
+	for _, col := range collectors {
+		if !cfg.Collectors.Enabled(col.Name()) {
+			continue
+		}
+		if ok, reason := col.Enabled(); !ok {
+			c.skip(col.Name(), reason)
+			continue
+		}
+		c.spawn(ctx, col)
+	}
+	c.wg.Wait()
+
+	fullSystemInfo := FullSystemInfo{CollectionErrors: c.statuses}
+	for _, col := range collectors {
+		result, ok := c.results[col.Name()]
+		if !ok {
+			continue
+		}
+		if m := syncMapperOf(col.Name()); m != nil && m.store != nil {
+			m.store(&fullSystemInfo, result)
+			continue
+		}
+		if r, ok := result.(plugins.Result); ok {
+			if fullSystemInfo.Plugins == nil {
+				fullSystemInfo.Plugins = map[string]plugins.Result{}
+			}
+			fullSystemInfo.Plugins[col.Name()] = r
+			continue
+		}
+		data, err := json.Marshal(result)
+		if err != nil {
+			log.Warnf("Error encoding the result of collector %s: %s", col.Name(), err)
+			continue
+		}
+		if fullSystemInfo.Extra == nil {
+			fullSystemInfo.Extra = map[string]json.RawMessage{}
+		}
+		fullSystemInfo.Extra[col.Name()] = data
+	}
+
+	elapsed := time.Since(start)
+	agentMetrics.Set("netbox_agent_collection_duration_seconds", nil, elapsed.Seconds())
+	durations := map[string]int64{}
+	for name, status := range fullSystemInfo.CollectionErrors {
+		durations[name] = status.DurationMs
+	}
+	log.WithField("durations_ms", durations).Infof("Collected the inventory in %s", elapsed.Round(time.Millisecond))
+
+	// The device can't be created without the system information
+	if status := fullSystemInfo.CollectionErrors["system"]; status.failed() {
+		return fullSystemInfo, &collectorError{collector: "system", err: errors.New(status.Error)}
+	}
+	if len(fullSystemInfo.System) == 0 {
+		return fullSystemInfo, fmt.Errorf("no system information available, enable the system collector")
+	}
+
+	observeHardware(cfg.Collectors, &fullSystemInfo)
+
+	if log.IsLevelEnabled(logrus.DebugLevel) {
+		finalJSON, err := json.MarshalIndent(fullSystemInfo, "", "  ")
+		if err == nil {
+			log.Debug(string(finalJSON))
+		}
+	}
+
+	return fullSystemInfo, nil
+}
+
+// isRegistered reports whether one of collectors is called name
+func isRegistered(collectors []collector.Collector, name string) bool {
+	for _, col := range collectors {
+		if col.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// spawn runs a collector in the background
+func (c *collection) spawn(ctx context.Context, col collector.Collector) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		result, err := c.run(ctx, col)
+		if err != nil {
+			return
+		}
+		c.mu.Lock()
+		c.results[col.Name()] = result
+		c.mu.Unlock()
+	}()
+}
+
+// record sets the status of a collector
+func (c *collection) record(name string, status collectorStatus) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.statuses[name] = status
+}
+
+// skip records a collector that found nothing to collect on this host
+func (c *collection) skip(name, reason string) {
+	log.WithField("collector", name).Debugf("Skipping collector %s: %s", name, reason)
+	c.record(name, collectorStatus{Status: collectorSkipped, Error: reason})
+}
+
+// run runs a collector under a deadline of collectors.timeout and records its status and duration.
+// A collector that doesn't return in time fails, it is left behind as blocking calls like ioctls can't be interrupted.
+func (c *collection) run(ctx context.Context, col collector.Collector) (interface{}, error) {
+	name := col.Name()
+	timeout := time.Duration(c.cfg.Collectors.Timeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		value interface{}
+		err   error
+	}
+	start := time.Now()
+	done := make(chan result, 1)
+	go func() {
+		value, err := col.Collect(ctx)
+		done <- result{value, err}
+	}()
+
+	var r result
+	select {
+	case r = <-done:
+	case <-ctx.Done():
+		// Give the collector a moment to kill the commands it started, the agent may exit right after
+		select {
+		case r = <-done:
+		case <-time.After(collectorGrace):
+		}
+	}
+	if ctx.Err() != nil {
+		r = result{nil, fmt.Errorf("%w after %s", errCollectorTimeout, timeout)}
+	}
+	observeCollector(name, start, r.err)
+
+	status := collectorStatus{Status: collectorOK, DurationMs: time.Since(start).Milliseconds()}
+	if r.err != nil {
+		status.Status, status.Error = collectorFailed, fmt.Sprintf("error collecting %s: %s", name, r.err)
+		if errors.Is(r.err, errCollectorTimeout) {
+			status.Status = collectorTimedOut
+		}
+		log.WithField("collector", name).Warn(status.Error)
+	} else {
+		log.WithField("collector", name).Debugf("Collector %s finished in %s", name, time.Since(start).Round(time.Millisecond))
+	}
+	c.record(name, status)
+
+	return r.value, r.err
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/iglov/netbox-agent/lib/config"
+	"github.com/joho/godotenv"
+)
+
+// configFlags maps command line flags to config keys, flags take precedence over file and environment
+var configFlags = map[string]string{
+	"loglevel": "log.level",
+	"url":      "netbox.url",
+	"site":     "resolution.site.name",
+	"role":     "resolution.role.name",
+	"tenant":   "resolution.tenant.name",
+	"textfile": "output.textfile",
+	"summary":  "output.summary",
+}
+
+// newFlagSet returns the flag set of a command with the flags shared by all commands
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.String("config", config.DefaultPath, "Path to the YAML config file.")
+	fs.String("loglevel", "info", "Set log level: DEBUG, INFO, WARN, ERROR")
+	fs.String("url", "", "NetBox URL, overrides netbox.url.")
+	fs.String("site", "", "Site name, overrides resolution.site.")
+	fs.String("role", "", "Device role name, overrides resolution.role.name.")
+	fs.String("tenant", "", "Tenant name, overrides resolution.tenant.name.")
+	fs.String("textfile", "", "node_exporter textfile (.prom) to write, overrides output.textfile.")
+	fs.String("summary", "", "Write the run summary as JSON to this file, overrides output.summary.")
+	fs.Bool("v", false, "Print current version and exit.")
+	return fs
+}
+
+// loadConfig merges defaults, config file, environment (including .env) and command line flags
+func loadConfig(fs *flag.FlagSet) (*config.Config, error) {
+	// The .env file is still supported, it only sets variables that are not in the environment yet
+	if err := godotenv.Load(); err != nil {
+		log.Debug("No .env file loaded, using local variables")
+	}
+
+	// Only an explicitly passed config file has to exist
+	cfg, err := config.Load(fs.Lookup("config").Value.String(), flagSet(fs, "config"))
+	if err != nil {
+		return nil, err
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		if key, ok := configFlags[f.Name]; ok && flagErr == nil {
+			flagErr = cfg.Set(key, f.Value.String())
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	// Derive slugs that were not given explicitly
+	if cfg.Resolution.Role.Slug == "" || flagSet(fs, "role") {
+		cfg.Resolution.Role.Slug = slugify(cfg.Resolution.Role.Name)
+	}
+	if cfg.Resolution.Tenant.Slug == "" || flagSet(fs, "tenant") {
+		cfg.Resolution.Tenant.Slug = slugify(cfg.Resolution.Tenant.Name)
+	}
+
+	return cfg, nil
+}
+
+// runConfig handles "config validate", it prints the merged config with secrets redacted
+func runConfig(args []string) int {
+	fs := newFlagSet("config")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 || fs.Arg(0) != "validate" {
+		fmt.Fprintln(os.Stderr, "usage: netbox-agent config [flags] validate")
+		return exitUsage
+	}
+
+	cfg, err := loadConfig(fs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	fmt.Print(cfg.String())
+
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	// An agent that sends its reports to an aggregator needs no NetBox settings
+	if err := validateTarget(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+func flagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// resolveSite returns the configured site name or extracts it from the hostname
+func resolveSite(cfg *config.Config, hostname string) (string, error) {
+	if cfg.Resolution.Site.Name != "" {
+		return cfg.Resolution.Site.Name, nil
+	}
+
+	match := regexp.MustCompile(cfg.Resolution.Site.HostnameRegex).FindStringSubmatch(hostname)
+	if len(match) < 2 || match[1] == "" {
+		return "", fmt.Errorf("hostname %s does not match %s", hostname, cfg.Resolution.Site.HostnameRegex)
+	}
+	return match[1], nil
+}
+
+// resolveDeviceName names the device according to naming.device
+func resolveDeviceName(cfg *config.Config, hostname, serial string) string {
+	name := hostname
+	switch cfg.Naming.Device {
+	case "short":
+		name = strings.Split(hostname, ".")[0]
+	case "serial":
+		name = serial
+	}
+
+	if cfg.Naming.Lowercase {
+		name = strings.ToLower(name)
+	}
+	return name
+}
+
+var slugInvalidChars = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// slugify turns a name into a NetBox slug
+func slugify(name string) string {
+	return strings.Trim(slugInvalidChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"flag"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/iglov/netbox-agent/lib/config"
+	"github.com/iglov/netbox-agent/lib/dmidecode"
+	"github.com/iglov/netbox-agent/lib/systemd"
+)
+
+// daemon syncs on an interval until it is stopped
+type daemon struct {
+	fs *flag.FlagSet
+
+	// cfg is replaced on reload, cfgMu guards it against the inventory endpoint
+	cfgMu sync.RWMutex
+	cfg   *config.Config
+
+	cache *inventoryCache
+
+	// mu is held while a sync runs, syncs never overlap
+	mu sync.Mutex
+}
+
+// runDaemon keeps running and syncs every daemon.interval.
+// SIGTERM and SIGINT stop it after the running sync, SIGHUP reloads the config and SIGUSR1 syncs immediately.
+func runDaemon(args []string) int {
+	fs := newFlagSet("daemon")
+
+	cfg, code := setup(fs, args, false)
+	if cfg == nil {
+		return code
+	}
+	if err := validateTarget(cfg); err != nil {
+		log.Error(err)
+		return exitUsage
+	}
+
+	lock, err := acquireLock(cfg.LockFile)
+	if err != nil {
+		log.Error(err)
+		return exitFailure
+	}
+	defer lock.release()
+
+	d := &daemon{fs: fs, cfg: cfg}
+	d.cache = &inventoryCache{
+		ttl:     time.Duration(cfg.HTTP.CacheTTL),
+		collect: func() (FullSystemInfo, error) { return collect(d.config()) },
+	}
+	return d.run()
+}
+
+func (d *daemon) run() int {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1)
+	defer signal.Stop(signals)
+
+	key := splayKey()
+	offset := splayOffset(key, d.cfg)
+	log.Infof("Syncing every %s at offset %s", time.Duration(d.cfg.Daemon.Interval), offset)
+
+	if d.cfg.Daemon.MetricsListen != "" {
+		if err := serveMetrics(d.cfg.Daemon.MetricsListen); err != nil {
+			log.Errorf("Error starting metrics listener: %s", err)
+			return exitFailure
+		}
+	}
+
+	if d.cfg.HTTP.Listen != "" {
+		if err := serveEndpoint(d.cfg.HTTP, d.cache); err != nil {
+			log.Errorf("Error starting inventory listener: %s", err)
+			return exitFailure
+		}
+	}
+
+	notify("READY=1")
+
+	// The loop pings the watchdog itself, so systemd restarts a daemon whose loop hangs
+	var watchdog <-chan time.Time
+	if interval := systemd.WatchdogInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+
+	// syncing is closed when the sync running in the background finishes, nil if none runs
+	var syncing chan struct{}
+	var syncStarted time.Time
+	pending := false
+	start := func() {
+		if syncing != nil {
+			// Run once more after the current sync instead of running two at once
+			pending = true
+			return
+		}
+		syncing, syncStarted = make(chan struct{}), time.Now()
+		go func(cfg *config.Config, done chan struct{}) {
+			defer close(done)
+			d.syncOnce(cfg)
+		}(d.cfg, syncing)
+	}
+
+	next := nextRun(time.Now(), time.Duration(d.cfg.Daemon.Interval), offset)
+	log.Infof("Next sync at %s", next.Format(time.RFC3339))
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			start()
+			next = nextRun(time.Now(), time.Duration(d.cfg.Daemon.Interval), offset)
+			timer.Reset(time.Until(next))
+
+		case <-watchdog:
+			// A sync still running after a whole interval hangs, the daemon is restarted instead of waiting for it
+			if syncing != nil && time.Since(syncStarted) > time.Duration(d.cfg.Daemon.Interval) {
+				log.Errorf("Sync running since %s, no longer notifying the watchdog", syncStarted.Format(time.RFC3339))
+				continue
+			}
+			notify("WATCHDOG=1")
+
+		case <-syncing:
+			syncing = nil
+			log.Infof("Next sync at %s", next.Format(time.RFC3339))
+			if pending {
+				pending = false
+				start()
+			}
+
+		case sig := <-signals:
+			switch sig {
+			case syscall.SIGHUP:
+				notify("RELOADING=1")
+				d.reload()
+				notify("READY=1")
+
+				offset = splayOffset(key, d.cfg)
+				next = nextRun(time.Now(), time.Duration(d.cfg.Daemon.Interval), offset)
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(time.Until(next))
+				log.Infof("Next sync at %s", next.Format(time.RFC3339))
+
+			case syscall.SIGUSR1:
+				log.Info("Received SIGUSR1, syncing now")
+				start()
+
+			default:
+				log.Infof("Received %s, shutting down", sig)
+				notify("STOPPING=1")
+				if syncing != nil {
+					log.Info("Waiting for the running sync to finish")
+					<-syncing
+				}
+				return exitOK
+			}
+		}
+	}
+}
+
+// syncOnce collects and writes the inventory to NetBox
+func (d *daemon) syncOnce(cfg *config.Config) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Every sync of the daemon is a run of its own
+	logContext.set("run_id", newRunID())
+
+	sum := newRunSummary(cfg, "daemon")
+	defer sum.finish()
+
+	rep, err := inventoryReport(cfg, "", "")
+	if err != nil {
+		log.Error(err)
+		for _, name := range targetNames(cfg) {
+			observeSyncResult(name, false)
+		}
+		reportRun(cfg, "daemon", nil, false)
+		sum.collectionFailed(err)
+		return
+	}
+	sum.collected(&rep.Inventory)
+
+	d.cache.store(rep.Inventory)
+
+	if cfg.Aggregator.URL != "" {
+		err := pushReport(cfg, rep)
+		if err != nil {
+			log.Error(err)
+			sum.failed(err)
+		}
+		observeSyncResult("aggregator", err == nil)
+		reportRun(cfg, "daemon", &rep.Inventory, err == nil)
+		return
+	}
+
+	targets, err := newTargets(cfg, false)
+	if err != nil {
+		log.Error(err)
+		for _, name := range targetNames(cfg) {
+			observeSyncResult(name, false)
+		}
+		reportRun(cfg, "daemon", &rep.Inventory, false)
+		sum.failed(err)
+		return
+	}
+
+	var sets []targetChanges
+	for _, t := range targets {
+		s := t.syncer()
+		s.syncInventory(rep.Host.Hostname, &rep.Inventory, true)
+		sets = append(sets, targetChanges{Target: t.name, Changes: s.changes})
+		observeSync(t.name, s)
+		sum.syncResult(t.name, s)
+	}
+	reportRun(cfg, "daemon", &rep.Inventory, sum.ExitCode == exitOK)
+	notifyChanges(cfg, "daemon", rep.Host.Hostname, sets)
+}
+
+// reload reads the config again, the old one is kept if the new one is invalid
+func (d *daemon) reload() {
+	log.Info("Received SIGHUP, reloading config")
+
+	cfg, err := loadConfig(d.fs)
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err == nil {
+		err = validateTarget(cfg)
+	}
+	if err != nil {
+		log.Errorf("Error reloading config, keeping the current one: %s", err)
+		return
+	}
+
+	if err := setupLogging(cfg); err != nil {
+		log.Errorf("Error setting up logging, keeping the current config: %s", err)
+		return
+	}
+
+	// The listeners are started once, their settings only apply after a restart
+	if cfg.Daemon.MetricsListen != d.cfg.Daemon.MetricsListen {
+		log.Warn("daemon.metrics_listen changed, restart the daemon to apply it")
+	}
+	if cfg.HTTP != d.cfg.HTTP {
+		log.Warn("http settings changed, restart the daemon to apply them")
+	}
+
+	d.cfgMu.Lock()
+	d.cfg = cfg
+	d.cfgMu.Unlock()
+}
+
+// config returns the current config
+func (d *daemon) config() *config.Config {
+	d.cfgMu.RLock()
+	defer d.cfgMu.RUnlock()
+
+	return d.cfg
+}
+
+// splayKey identifies the host for the splay, the system serial or the hostname if there is none
+func splayKey() string {
+	if table, err := dmidecode.ReadTable(); err == nil {
+		if system, err := table.System(); err == nil && len(system) > 0 && system[0].SerialNumber != "" {
+			return system[0].SerialNumber
+		}
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// splayOffset derives a fixed offset within daemon.splay from the key,
+// so every host syncs at its own time but always at the same time
+func splayOffset(key string, cfg *config.Config) time.Duration {
+	splay := time.Duration(cfg.Daemon.Splay)
+	if splay <= 0 {
+		return 0
+	}
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return time.Duration(h.Sum64() % uint64(splay))
+}
+
+// nextRun returns the next time after now that is offset past a multiple of interval
+func nextRun(now time.Time, interval, offset time.Duration) time.Time {
+	next := now.Truncate(interval).Add(offset % interval)
+	for !next.After(now) {
+		next = next.Add(interval)
+	}
+	return next
+}
+
+// serveMetrics serves /metrics on addr in the background
+func serveMetrics(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", agentMetrics.Handler())
+
+	log.Infof("Serving metrics on %s/metrics", listener.Addr())
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Errorf("Error serving metrics: %s", err)
+		}
+	}()
+	return nil
+}
+
+// notify tells systemd about the state of the daemon
+func notify(state string) {
+	if err := systemd.Notify(state); err != nil {
+		log.Debugf("Error notifying systemd: %s", err)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/iglov/netbox-agent/lib/config"
+)
+
+// inventoryCache holds the last collected inventory, it is collected again once it is older than ttl
+type inventoryCache struct {
+	ttl     time.Duration
+	collect func() (FullSystemInfo, error)
+
+	// collecting is held while collecting, concurrent requests wait for the same collection
+	collecting sync.Mutex
+
+	mu          sync.Mutex
+	info        *FullSystemInfo
+	collectedAt time.Time
+
+	// A failed collection is not retried before ttl either, unless forced
+	lastErr  error
+	failedAt time.Time
+}
+
+// store replaces the cached inventory, e.g. with the one collected by a sync
+func (c *inventoryCache) store(info FullSystemInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.info = &info
+	c.collectedAt = time.Now()
+}
+
+// cached returns the cached inventory and when it was collected, nil if there is none
+func (c *inventoryCache) cached() (*FullSystemInfo, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.info, c.collectedAt
+}
+
+// get returns the cached inventory, collecting it first if it is missing, expired or force is set
+func (c *inventoryCache) get(force bool) (*FullSystemInfo, time.Time, error) {
+	requested := time.Now()
+
+	c.collecting.Lock()
+	defer c.collecting.Unlock()
+
+	info, collectedAt := c.cached()
+	// A collection that finished while waiting is fresh enough, even if forced
+	fresh := info != nil && (collectedAt.After(requested) || (!force && time.Since(collectedAt) < c.ttl))
+	if fresh {
+		return info, collectedAt, nil
+	}
+	if !force && c.lastErr != nil && time.Since(c.failedAt) < c.ttl {
+		return info, collectedAt, c.lastErr
+	}
+
+	collected, err := c.collect()
+	if err != nil {
+		c.lastErr, c.failedAt = err, time.Now()
+		return info, collectedAt, err
+	}
+	c.lastErr = nil
+	c.store(collected)
+
+	info, collectedAt = c.cached()
+	return info, collectedAt, nil
+}
+
+// endpoint serves the inventory of this host over HTTP
+type endpoint struct {
+	cache *inventoryCache
+	token string
+	// minRefresh is the least time between two collections forced by /refresh
+	minRefresh time.Duration
+
+	mu          sync.Mutex
+	refreshedAt time.Time
+}
+
+func (e *endpoint) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", e.healthz)
+	mux.HandleFunc("/readyz", e.readyz)
+	mux.Handle("/inventory", e.authorize(http.HandlerFunc(e.inventory)))
+	mux.Handle("/refresh", e.authorize(http.HandlerFunc(e.refresh)))
+	return mux
+}
+
+// authorize requires the bearer token if one is configured
+func (e *endpoint) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if e.token != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(e.token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (e *endpoint) healthz(w http.ResponseWriter, _ *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz succeeds once an inventory was collected
+func (e *endpoint) readyz(w http.ResponseWriter, _ *http.Request) {
+	if info, _ := e.cache.cached(); info == nil {
+		http.Error(w, "no inventory collected yet", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// inventory serves the cached FullSystemInfo as JSON
+func (e *endpoint) inventory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	e.serveInventory(w, false)
+}
+
+// refresh collects the inventory again and serves it.
+// Collecting runs the collectors as root, so it needs the token and is limited to once per minRefresh.
+func (e *endpoint) refresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if e.token == "" {
+		http.Error(w, "refresh is disabled without http.token", http.StatusForbidden)
+		return
+	}
+	if wait := e.refreshWait(); wait > 0 {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(wait.Seconds()+1)))
+		http.Error(w, "refreshed too recently", http.StatusTooManyRequests)
+		return
+	}
+	e.serveInventory(w, true)
+}
+
+// refreshWait returns how long a refresh has to wait for minRefresh to pass, and takes the slot if it doesn't
+func (e *endpoint) refreshWait() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if wait := e.minRefresh - time.Since(e.refreshedAt); wait > 0 {
+		return wait
+	}
+	e.refreshedAt = time.Now()
+	return 0
+}
+
+func (e *endpoint) serveInventory(w http.ResponseWriter, force bool) {
+	info, collectedAt, err := e.cache.get(force)
+	if err != nil {
+		log.Errorf("Error collecting inventory: %s", err)
+		if info == nil {
+			http.Error(w, "error collecting inventory", http.StatusInternalServerError)
+			return
+		}
+		// Serve the last good inventory, its age tells the client it is stale
+	}
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		http.Error(w, "error marshalling inventory", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Last-Modified", collectedAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Age", fmt.Sprintf("%d", int(time.Since(collectedAt).Seconds())))
+	_, _ = w.Write(append(data, '\n'))
+}
+
+// listen opens a TCP address, or a unix socket given as unix:/path
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	// A socket left behind by a previous run would make listening fail
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Access is controlled by the permissions of the directory and the token, /refresh needs the token
+	if err := os.Chmod(path, 0o666); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// serveEndpoint starts the inventory endpoint in the background
+func serveEndpoint(cfg config.HTTPConfig, cache *inventoryCache) error {
+	listener, err := listen(cfg.Listen)
+	if err != nil {
+		return err
+	}
+
+	e := &endpoint{cache: cache, token: cfg.Token, minRefresh: time.Duration(cfg.MinRefresh)}
+
+	log.Infof("Serving inventory on %s", cfg.Listen)
+	go func() {
+		if err := http.Serve(listener, e.handler()); err != nil {
+			log.Errorf("Error serving inventory: %s", err)
+		}
+	}()
+	return nil
+}
+
+// runServe serves the inventory without syncing to NetBox
+func runServe(args []string) int {
+	fs := newFlagSet("serve")
+
+	cfg, code := setup(fs, args, false)
+	if cfg == nil {
+		return code
+	}
+
+	if cfg.HTTP.Listen == "" {
+		log.Error("http.listen is empty")
+		return exitUsage
+	}
+
+	cache := &inventoryCache{
+		ttl:     time.Duration(cfg.HTTP.CacheTTL),
+		collect: func() (FullSystemInfo, error) { return collect(cfg) },
+	}
+	if err := serveEndpoint(cfg.HTTP, cache); err != nil {
+		log.Errorf("Error starting inventory listener: %s", err)
+		return exitFailure
+	}
+
+	// Collect right away so /readyz turns ready
+	go func() {
+		if _, _, err := cache.get(false); err != nil {
+			log.Error(err)
+		}
+	}()
+
+	notify("READY=1")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	log.Infof("Received %s, shutting down", sig)
+	notify("STOPPING=1")
+
+	return exitOK
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRefresh(t *testing.T) {
+	collections := 0
+	newEndpoint := func(token string) *endpoint {
+		cache := &inventoryCache{ttl: time.Hour, collect: func() (FullSystemInfo, error) {
+			collections++
+			return FullSystemInfo{}, nil
+		}}
+		return &endpoint{cache: cache, token: token, minRefresh: time.Minute}
+	}
+	refresh := func(e *endpoint, token string) int {
+		req := httptest.NewRequest(http.MethodPost, "/refresh", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		e.handler().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := refresh(newEndpoint(""), ""); code != http.StatusForbidden {
+		t.Errorf("refresh without http.token = %d, want %d", code, http.StatusForbidden)
+	}
+
+	e := newEndpoint("secret")
+	if code := refresh(e, ""); code != http.StatusUnauthorized {
+		t.Errorf("refresh without token = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := refresh(e, "secret"); code != http.StatusOK {
+		t.Errorf("refresh = %d, want %d", code, http.StatusOK)
+	}
+	if code := refresh(e, "secret"); code != http.StatusTooManyRequests {
+		t.Errorf("second refresh = %d, want %d", code, http.StatusTooManyRequests)
+	}
+	if collections != 1 {
+		t.Errorf("collections = %d, want 1", collections)
+	}
+}
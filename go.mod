@@ -8,6 +8,7 @@ require (
 	github.com/sirupsen/logrus v1.9.3
 	github.com/u-root/u-root v0.14.0
 	github.com/yumaojun03/dmidecode v0.1.4
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/iglov/netbox-agent/lib/config"
+)
+
+// changeSetVersion is the version of the change set document given to the post-sync hook and the webhook
+const changeSetVersion = 1
+
+// webhookSignatureHeader carries the HMAC-SHA256 of the request body as "sha256=<hex>"
+const webhookSignatureHeader = "X-Netbox-Agent-Signature"
+
+// maxHookOutput limits what is read from the stdout of a hook, enough for a report
+const maxHookOutput = 16 << 20
+
+// changeSet is the result of a sync as given to the post-sync hook and the webhook
+type changeSet struct {
+	Version  int             `json:"version"`
+	Command  string          `json:"command"`
+	RunID    string          `json:"run_id,omitempty"`
+	Hostname string          `json:"hostname"`
+	SyncedAt time.Time       `json:"synced_at"`
+	Targets  []targetChanges `json:"targets"`
+}
+
+// changes counts the changes of all targets
+func (c *changeSet) changes() int {
+	n := 0
+	for _, t := range c.Targets {
+		n += len(t.Changes)
+	}
+	return n
+}
+
+// preCollect runs the pre-collect hook, the inventory isn't collected if it fails
+func preCollect(cfg *config.Config) error {
+	if cfg.Hooks.PreCollect == "" {
+		return nil
+	}
+	if _, err := runHook(cfg, "pre_collect", cfg.Hooks.PreCollect, nil); err != nil {
+		return fmt.Errorf("pre_collect hook failed: %v", err)
+	}
+	return nil
+}
+
+// postCollect gives the report to the post-collect hook on stdin.
+// The hook vetoes the run by failing, and replaces the report by printing another one; no output keeps it as it is.
+func postCollect(cfg *config.Config, rep *report) (*report, error) {
+	if cfg.Hooks.PostCollect == "" {
+		return rep, nil
+	}
+
+	data, err := json.Marshal(rep)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling report: %s", err)
+	}
+	out, err := runHook(cfg, "post_collect", cfg.Hooks.PostCollect, data)
+	if err != nil {
+		return nil, fmt.Errorf("post_collect hook vetoed the run: %v", err)
+	}
+	if len(bytes.TrimSpace(out)) == 0 {
+		return rep, nil
+	}
+
+	// Like any report reader, fields this agent doesn't know are ignored
+	var modified report
+	if err := json.Unmarshal(out, &modified); err != nil {
+		return nil, fmt.Errorf("error parsing the report of the post_collect hook: %v", err)
+	}
+	if err := modified.validate(); err != nil {
+		return nil, fmt.Errorf("invalid report of the post_collect hook: %v", err)
+	}
+	log.Info("Using the report modified by the post_collect hook")
+	return &modified, nil
+}
+
+// notifyChanges hands the change set of a sync to the post-sync hook and the webhook.
+// The hook runs after every sync, the webhook only if something changed. Their failures are logged, the sync result stays.
+func notifyChanges(cfg *config.Config, command, hostname string, sets []targetChanges) {
+	if cfg.Hooks.PostSync == "" && cfg.Hooks.Webhook.URL == "" {
+		return
+	}
+
+	set := changeSet{Version: changeSetVersion, Command: command, Hostname: hostname, SyncedAt: time.Now().UTC(), Targets: sets}
+	if id, ok := logContext.get("run_id").(string); ok {
+		set.RunID = id
+	}
+	for i := range set.Targets {
+		if set.Targets[i].Changes == nil {
+			set.Targets[i].Changes = []change{}
+		}
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		log.Errorf("Error marshalling changes: %s", err)
+		return
+	}
+
+	if cfg.Hooks.PostSync != "" {
+		if _, err := runHook(cfg, "post_sync", cfg.Hooks.PostSync, data); err != nil {
+			log.Errorf("post_sync hook failed: %s", err)
+		}
+	}
+	if cfg.Hooks.Webhook.URL != "" && set.changes() > 0 {
+		if err := postWebhook(cfg, data); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// runHook runs command with /bin/sh under hooks.timeout, with stdin as its input, and returns its stdout.
+// The hook and anything it started are killed when the time is up.
+func runHook(cfg *config.Config, name, command string, stdin []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Hooks.Timeout))
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &limitedWriter{buf: &stdout, limit: maxHookOutput + 1}
+	cmd.Stderr = &limitedWriter{buf: &stderr, limit: 4096}
+	cmd.Env = append(os.Environ(), "NETBOX_AGENT_HOOK="+name)
+	if id, ok := logContext.get("run_id").(string); ok {
+		cmd.Env = append(cmd.Env, "NETBOX_AGENT_RUN_ID="+id)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = time.Second
+
+	log.WithField("hook", name).Debugf("Running %s hook", name)
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("timed out after %s", time.Duration(cfg.Hooks.Timeout))
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, err
+	}
+	if stdout.Len() > maxHookOutput {
+		return nil, fmt.Errorf("output is larger than %d bytes", maxHookOutput)
+	}
+	return stdout.Bytes(), nil
+}
+
+// postWebhook posts the change set to hooks.webhook.url, signed with hooks.webhook.secret
+func postWebhook(cfg *config.Config, data []byte) error {
+	mac := hmac.New(sha256.New, []byte(cfg.Hooks.Webhook.Secret))
+	mac.Write(data)
+
+	req, err := http.NewRequest(http.MethodPost, cfg.Hooks.Webhook.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "netbox-agent/"+Version)
+	req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	client := &http.Client{Timeout: time.Duration(cfg.Hooks.Timeout)}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending webhook: %w", err)
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("error sending webhook: %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+
+	log.Debugf("Changes sent to %s", cfg.Hooks.Webhook.URL)
+	return nil
+}
+
+// limitedWriter keeps the first limit bytes written to it and drops the rest
+type limitedWriter struct {
+	buf   *bytes.Buffer
+	limit int
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if room := w.limit - w.buf.Len(); room > 0 {
+		if len(p) > room {
+			w.buf.Write(p[:room])
+		} else {
+			w.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
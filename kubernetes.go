@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/iglov/netbox-agent/lib/kubernetes"
+	"github.com/netbox-community/go-netbox/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// syncKubernetes adds this device to the cluster of its kubelet if member is set and maps allowed node labels to tags
+func (s *syncer) syncKubernetes(hostname, site string, member bool) {
+	if !kubernetes.IsPresent() {
+		log.Debug("kubelet not found, skipping Kubernetes cluster membership")
+		return
+	}
+
+	nodeInfo, err := kubernetes.GetNodeInfo(kubernetes.Options{
+		ClusterName: s.cfg.Collectors.Kubernetes.ClusterName,
+		NodeName:    s.cfg.Collectors.Kubernetes.NodeName,
+		Kubeconfig:  s.cfg.Collectors.Kubernetes.Kubeconfig,
+	})
+	if err != nil {
+		s.failCollector("kubernetes", "Error detecting Kubernetes node", err)
+		return
+	}
+
+	log.WithFields(logrus.Fields{
+		"node":    nodeInfo.NodeName,
+		"cluster": nodeInfo.ClusterName,
+		"server":  nodeInfo.Server,
+		"labels":  len(nodeInfo.Labels),
+	}).Debug("Detected Kubernetes node")
+	if nodeInfo.LabelsErr != nil {
+		log.Warnf("Error reading the labels of node %s from the API server, using the kubelet flags: %s", nodeInfo.NodeName, nodeInfo.LabelsErr)
+	}
+
+	if member {
+		if cluster := s.ensureCluster(nodeInfo.ClusterName, "kubernetes", site); cluster != nil {
+			s.assignDeviceToCluster(hostname, cluster)
+		}
+	} else {
+		log.Infof("Device %s is a member of a cluster before kubernetes in collectors.cluster_precedence, not adding it to %s", hostname, nodeInfo.ClusterName)
+	}
+
+	// Only labels from the allow-list become tags
+	allowed := map[string]bool{}
+	for _, key := range s.cfg.Collectors.Kubernetes.LabelTags {
+		allowed[key] = true
+	}
+
+	owned, ok := s.ownedLabelTags()
+	if !ok {
+		return
+	}
+	if len(allowed) == 0 && len(owned) == 0 {
+		return
+	}
+
+	var tags []netbox.NestedTagRequest
+	for key, value := range nodeInfo.Labels {
+		if allowed[key] {
+			tags = append(tags, labelTag(key, value))
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+
+	// Label tags created by the agent are replaced, also those of labels that were removed from the allow-list.
+	// Tags of allowed labels created before are recognized by their key, any other tag is kept.
+	managed := func(name string) bool {
+		key, _, _ := strings.Cut(name, "=")
+		return owned[name] || allowed[key]
+	}
+
+	for _, tag := range tags {
+		s.ensureTag(tag, labelTagDescription)
+	}
+	s.syncDeviceTags(hostname, tags, managed)
+}
+
+// labelTagDescription marks the tags created for node labels
+const labelTagDescription = "Kubernetes node label, managed by netbox-agent"
+
+// ownedLabelTags returns the names of the label tags created by the agent, ok is false if they could not be listed
+func (s *syncer) ownedLabelTags() (map[string]bool, bool) {
+	tagRes, _, err := s.c.ExtrasAPI.ExtrasTagsList(s.ctx).Description([]string{labelTagDescription}).Limit(1000).Execute()
+	if err != nil {
+		s.fail("extras.tag", "Error listing tags", err)
+		return nil, false
+	}
+	debugResponse(tagRes)
+
+	owned := map[string]bool{}
+	for _, tag := range tagRes.Results {
+		owned[tag.Name] = true
+	}
+	return owned, true
+}
+
+// labelTag maps a node label to a tag named key=value
+func labelTag(key, value string) netbox.NestedTagRequest {
+	name := key + "=" + value
+	return netbox.NestedTagRequest{Name: name, Slug: slugify(name)}
+}
+
+// syncDeviceTags sets the tags on the device, they have to exist.
+// Existing device tags for which managed returns true are dropped if they are not in tags.
+func (s *syncer) syncDeviceTags(deviceName string, tags []netbox.NestedTagRequest, managed func(name string) bool) {
+	deviceRes, _, err := s.c.DcimAPI.DcimDevicesList(s.ctx).Name([]string{deviceName}).Execute()
+	if err != nil {
+		s.fail("dcim.device", "Error listing devices", err)
+		return
+	}
+	debugResponse(deviceRes)
+
+	var deviceTags []netbox.NestedTag
+	var deviceID int32
+	if len(deviceRes.Results) > 0 {
+		deviceID = deviceRes.Results[0].Id
+		deviceTags = deviceRes.Results[0].Tags
+	} else if !s.dryRun {
+		s.fail("dcim.device", "Error setting device tags", fmt.Errorf("device %s not found", deviceName))
+		return
+	}
+
+	wanted := map[string]bool{}
+	for _, tag := range tags {
+		wanted[tag.Slug] = true
+	}
+
+	var names []string
+	var newTags []netbox.NestedTagRequest
+	for _, tag := range deviceTags {
+		if managed(tag.Name) && !wanted[tag.Slug] {
+			names = append(names, "-"+tag.Name)
+			continue
+		}
+		delete(wanted, tag.Slug)
+		newTags = append(newTags, netbox.NestedTagRequest{Name: tag.Name, Slug: tag.Slug})
+	}
+	for _, tag := range tags {
+		if wanted[tag.Slug] {
+			names = append(names, "+"+tag.Name)
+			newTags = append(newTags, tag)
+		}
+	}
+
+	if len(names) == 0 {
+		s.unchanged("dcim.device", deviceName)
+		return
+	}
+	if !s.record("update", "dcim.device", deviceName, map[string]interface{}{"tags": names}) {
+		return
+	}
+
+	patch := netbox.NewPatchedWritableDeviceWithConfigContextRequestWithDefaults()
+	patch.SetTags(newTags)
+
+	patchRes, _, err := s.c.DcimAPI.DcimDevicesPartialUpdate(s.ctx, deviceID).PatchedWritableDeviceWithConfigContextRequest(*patch).Execute()
+	if err != nil {
+		s.fail("dcim.device", "Error setting device tags", err)
+		return
+	}
+	debugResponse(patchRes)
+}
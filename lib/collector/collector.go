@@ -0,0 +1,127 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Collector gathers one class of hardware information of the host.
+type Collector interface {
+	// Name identifies the collector in the config, the report and collection_errors
+	Name() string
+	// Enabled reports whether the collector has anything to collect on this host, e.g. whether the IPMI device exists.
+	// If not, reason says why it is skipped.
+	Enabled() (ok bool, reason string)
+	// Collect gathers the information, it should give up when ctx is done
+	Collect(ctx context.Context) (interface{}, error)
+}
+
+// Typed is a collector whose result has the type T.
+type Typed[T any] struct {
+	name    string
+	enabled func() (bool, string)
+	collect func(ctx context.Context) (T, error)
+}
+
+// New returns a collector that is enabled on every host.
+func New[T any](name string, collect func(ctx context.Context) (T, error)) *Typed[T] {
+	return &Typed[T]{name: name, collect: collect}
+}
+
+// When makes the collector only run on hosts for which enabled returns true.
+func (c *Typed[T]) When(enabled func() (bool, string)) *Typed[T] {
+	c.enabled = enabled
+	return c
+}
+
+// Name implements Collector.
+func (c *Typed[T]) Name() string {
+	return c.name
+}
+
+// Enabled implements Collector.
+func (c *Typed[T]) Enabled() (bool, string) {
+	if c.enabled == nil {
+		return true, ""
+	}
+	return c.enabled()
+}
+
+// Collect implements Collector.
+func (c *Typed[T]) Collect(ctx context.Context) (interface{}, error) {
+	return c.collect(ctx)
+}
+
+// Result returns a result of Collect as T, ok is false if it isn't one.
+func (c *Typed[T]) Result(result interface{}) (value T, ok bool) {
+	value, ok = result.(T)
+	return value, ok
+}
+
+var (
+	mu         sync.Mutex
+	collectors []Collector
+)
+
+// Register adds a collector, packages register their collectors in init.
+// The collectors run in the order they were registered in.
+func Register(c Collector) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, known := range collectors {
+		if known.Name() == c.Name() {
+			panic(fmt.Sprintf("collector %s is registered twice", c.Name()))
+		}
+	}
+	collectors = append(collectors, c)
+}
+
+// All returns the registered collectors.
+func All() []Collector {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return append([]Collector(nil), collectors...)
+}
+
+type cacheKey struct{}
+
+type cache struct {
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+type entry struct {
+	once  sync.Once
+	value interface{}
+	err   error
+}
+
+// WithCache returns a context in which collectors share the values loaded with Cached,
+// e.g. a table several collectors decode.
+func WithCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, cacheKey{}, &cache{entries: map[string]*entry{}})
+}
+
+// Cached returns the value of key, load runs once per context returned by WithCache.
+// Without such a context load runs on every call.
+func Cached[T any](ctx context.Context, key string, load func() (T, error)) (T, error) {
+	c, ok := ctx.Value(cacheKey{}).(*cache)
+	if !ok {
+		return load()
+	}
+
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if !ok {
+		e = &entry{}
+		c.entries[key] = e
+	}
+	c.mu.Unlock()
+
+	e.once.Do(func() { e.value, e.err = load() })
+	value, _ := e.value.(T)
+	return value, e.err
+}
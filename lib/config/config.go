@@ -0,0 +1,716 @@
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultPath is the location of the configuration file when none is given
+const DefaultPath = "/etc/netbox-agent/config.yaml"
+
+// Redacted replaces secrets when the config is printed
+const Redacted = "<redacted>"
+
+// Config holds the agent configuration.
+// Fields tagged with env can be overridden from the environment, fields tagged
+// with secret are redacted when the config is printed.
+type Config struct {
+	NetBox     NetBoxConfig     `yaml:"netbox"`
+	Targets    []TargetConfig   `yaml:"targets"`
+	Resolution ResolutionConfig `yaml:"resolution"`
+	Collectors CollectorsConfig `yaml:"collectors"`
+	Naming     NamingConfig     `yaml:"naming"`
+	Sync       SyncConfig       `yaml:"sync"`
+	Daemon     DaemonConfig     `yaml:"daemon"`
+	Output     OutputConfig     `yaml:"output"`
+	HTTP       HTTPConfig       `yaml:"http"`
+	Aggregator AggregatorConfig `yaml:"aggregator"`
+	Server     ServerConfig     `yaml:"server"`
+	Signing    SigningConfig    `yaml:"signing"`
+	Hooks      HooksConfig      `yaml:"hooks"`
+	Log        LogConfig        `yaml:"log"`
+	// LockFile keeps a second agent from running while one syncs, disabled if empty
+	LockFile string `yaml:"lock_file" env:"LOCK_FILE"`
+}
+
+// NetBoxConfig holds the NetBox connection settings.
+type NetBoxConfig struct {
+	URL   string `yaml:"url" env:"API_URL"`
+	Token string `yaml:"token" env:"API_TOKEN" secret:"true"`
+	// TokenFile holds the token if token is empty, it is read again when it changes
+	TokenFile string `yaml:"token_file" env:"API_TOKEN_FILE"`
+	// TokenCredential is the name of a systemd credential (LoadCredential=) holding the token
+	TokenCredential string `yaml:"token_credential" env:"API_TOKEN_CREDENTIAL"`
+	// TokenCommand prints the token, it runs again when NetBox rejects the token
+	TokenCommand string `yaml:"token_command" env:"API_TOKEN_COMMAND"`
+
+	// CAFile is a PEM bundle used instead of the system CAs to verify NetBox
+	CAFile        string `yaml:"ca_file" env:"NETBOX_CA_FILE"`
+	TLSCert       string `yaml:"tls_cert" env:"NETBOX_TLS_CERT"`
+	TLSKey        string `yaml:"tls_key" env:"NETBOX_TLS_KEY"`
+	TLSMinVersion string `yaml:"tls_min_version" env:"NETBOX_TLS_MIN_VERSION"`
+	// InsecureSkipVerify disables the verification of the NetBox certificate, for testing only
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify" env:"NETBOX_INSECURE_SKIP_VERIFY"`
+	// Proxy is a proxy URL, "env" to use HTTPS_PROXY and NO_PROXY or "none" to connect directly
+	Proxy   string            `yaml:"proxy" env:"NETBOX_PROXY"`
+	Headers map[string]string `yaml:"headers" secret:"true"`
+	Timeout Duration          `yaml:"timeout" env:"NETBOX_TIMEOUT"`
+}
+
+// TargetConfig is one of several NetBox instances the inventory is synced to.
+// Settings a target doesn't list use the built-in defaults, not the top level netbox and sync sections.
+type TargetConfig struct {
+	Name string `yaml:"name"`
+	// Mode is sync to write to NetBox or plan to only log the changes
+	Mode   string       `yaml:"mode"`
+	NetBox NetBoxConfig `yaml:"netbox"`
+	Sync   SyncConfig   `yaml:"sync"`
+}
+
+// UnmarshalYAML starts a target from the defaults.
+func (t *TargetConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain TargetConfig
+
+	defaults := Default()
+	target := plain{Mode: "sync", NetBox: defaults.NetBox, Sync: defaults.Sync}
+	if err := value.Decode(&target); err != nil {
+		return err
+	}
+	*t = TargetConfig(target)
+	return nil
+}
+
+// ResolutionConfig controls how site, role and tenant of the device are found.
+type ResolutionConfig struct {
+	Site   SiteConfig   `yaml:"site"`
+	Role   ObjectConfig `yaml:"role"`
+	Tenant ObjectConfig `yaml:"tenant"`
+}
+
+// SiteConfig sets the site by name, or by the first capture group of a regex applied to the hostname.
+type SiteConfig struct {
+	Name          string `yaml:"name" env:"SITE"`
+	HostnameRegex string `yaml:"hostname_regex" env:"SITE_HOSTNAME_REGEX"`
+}
+
+// ObjectConfig references a NetBox object by name, the slug is derived from the name if empty.
+type ObjectConfig struct {
+	Name string `yaml:"name"`
+	Slug string `yaml:"slug"`
+}
+
+// CollectorsConfig enables the collectors.
+type CollectorsConfig struct {
+	Memory     bool             `yaml:"memory"`
+	CPU        bool             `yaml:"cpu"`
+	IPMI       bool             `yaml:"ipmi"`
+	Chassis    bool             `yaml:"chassis"`
+	System     bool             `yaml:"system"`
+	Storage    bool             `yaml:"storage"`
+	Libvirt    LibvirtConfig    `yaml:"libvirt"`
+	Proxmox    ProxmoxConfig    `yaml:"proxmox"`
+	Kubernetes KubernetesConfig `yaml:"kubernetes"`
+	// ClusterPrecedence orders libvirt, proxmox and kubernetes, the device is a member of the first detected cluster only
+	ClusterPrecedence []string `yaml:"cluster_precedence" env:"CLUSTER_PRECEDENCE"`
+	// Disable lists collectors that don't run, for collectors without a switch of their own
+	Disable []string `yaml:"disable" env:"COLLECTORS_DISABLE"`
+	// PluginDir holds executable collector plugins, each prints its result as JSON
+	PluginDir string `yaml:"plugin_dir" env:"COLLECTORS_PLUGIN_DIR"`
+	// Timeout is the deadline of each collector, a collector still running after it has failed
+	Timeout Duration `yaml:"timeout" env:"COLLECTOR_TIMEOUT"`
+}
+
+// Enabled reports whether the collector name runs.
+// The hardware collectors have a switch of their own, any other collector runs unless it is in disable.
+func (c CollectorsConfig) Enabled(name string) bool {
+	switch name {
+	case "memory":
+		return c.Memory
+	case "cpu":
+		return c.CPU
+	case "ipmi":
+		return c.IPMI
+	case "chassis":
+		return c.Chassis
+	case "system":
+		return c.System
+	case "storage":
+		return c.Storage
+	}
+	for _, disabled := range c.Disable {
+		if disabled == name {
+			return false
+		}
+	}
+	return true
+}
+
+// LibvirtConfig holds the libvirt guest inventory settings.
+type LibvirtConfig struct {
+	Enabled         bool   `yaml:"enabled"`
+	UndefinedStatus string `yaml:"undefined_status" env:"LIBVIRT_UNDEFINED_STATUS"`
+}
+
+// ProxmoxConfig holds the Proxmox VE discovery settings.
+type ProxmoxConfig struct {
+	Enabled         bool   `yaml:"enabled"`
+	UndefinedStatus string `yaml:"undefined_status" env:"PROXMOX_UNDEFINED_STATUS"`
+}
+
+// KubernetesConfig holds the Kubernetes node detection settings.
+type KubernetesConfig struct {
+	Enabled     bool     `yaml:"enabled"`
+	ClusterName string   `yaml:"cluster_name" env:"K8S_CLUSTER_NAME"`
+	NodeName    string   `yaml:"node_name" env:"K8S_NODE_NAME"`
+	Kubeconfig  string   `yaml:"kubeconfig" env:"K8S_KUBECONFIG"`
+	LabelTags   []string `yaml:"label_tags" env:"K8S_LABEL_TAGS"`
+}
+
+// NamingConfig controls how the device is named.
+type NamingConfig struct {
+	// Device is one of hostname (as returned by the OS), short (up to the first dot) or serial
+	Device    string `yaml:"device" env:"DEVICE_NAME"`
+	Lowercase bool   `yaml:"lowercase"`
+}
+
+// SyncConfig controls which objects are written to NetBox.
+type SyncConfig struct {
+	CreateSite     bool `yaml:"create_site"`
+	CreateRole     bool `yaml:"create_role"`
+	Chassis        bool `yaml:"chassis"`
+	InventoryItems bool `yaml:"inventory_items"`
+	BmcInterface   bool `yaml:"bmc_interface"`
+	// BIOSCustomFields sets the bios_version and bios_date custom fields of the device, they have to exist in NetBox
+	BIOSCustomFields bool `yaml:"bios_custom_fields"`
+	// OwnerTag marks objects created by the agent, only those are updated, deleted and purged
+	OwnerTag string `yaml:"owner_tag" env:"OWNER_TAG"`
+}
+
+// DaemonConfig holds the settings of the daemon command.
+type DaemonConfig struct {
+	Interval Duration `yaml:"interval" env:"DAEMON_INTERVAL"`
+	// Splay spreads the syncs of many hosts, each host syncs at a fixed offset within it
+	Splay Duration `yaml:"splay" env:"DAEMON_SPLAY"`
+	// MetricsListen is the address of the Prometheus /metrics listener, e.g. 127.0.0.1:9109; disabled if empty
+	MetricsListen string `yaml:"metrics_listen" env:"METRICS_LISTEN"`
+}
+
+// OutputConfig holds additional outputs of a run.
+type OutputConfig struct {
+	// Textfile is a .prom file for the node_exporter textfile collector, disabled if empty
+	Textfile string `yaml:"textfile" env:"TEXTFILE"`
+	// Summary is a file the summary of each run is written to as JSON, disabled if empty
+	Summary string `yaml:"summary" env:"SUMMARY_FILE"`
+}
+
+// HTTPConfig holds the settings of the local inventory endpoint.
+type HTTPConfig struct {
+	// Listen is a TCP address such as 127.0.0.1:9110 or unix:/path/to/socket, disabled if empty
+	Listen string `yaml:"listen" env:"HTTP_LISTEN"`
+	// Token is required as bearer token for /inventory and /refresh if set, /refresh is disabled without it
+	Token    string   `yaml:"token" env:"HTTP_TOKEN" secret:"true"`
+	CacheTTL Duration `yaml:"cache_ttl" env:"HTTP_CACHE_TTL"`
+	// MinRefresh is the least time between two collections forced by /refresh
+	MinRefresh Duration `yaml:"min_refresh" env:"HTTP_MIN_REFRESH"`
+}
+
+// AggregatorConfig makes agents send their reports to an aggregator instead of writing to NetBox.
+type AggregatorConfig struct {
+	URL    string `yaml:"url" env:"AGGREGATOR_URL"`
+	Token  string `yaml:"token" env:"AGGREGATOR_TOKEN" secret:"true"`
+	CAFile string `yaml:"ca_file" env:"AGGREGATOR_CA_FILE"`
+	// TLSCert and TLSKey authenticate the agent with a client certificate instead of the token
+	TLSCert string `yaml:"tls_cert" env:"AGGREGATOR_TLS_CERT"`
+	TLSKey  string `yaml:"tls_key" env:"AGGREGATOR_TLS_KEY"`
+}
+
+// ServerConfig holds the settings of the server command, the aggregator receiving agent reports.
+type ServerConfig struct {
+	Listen  string `yaml:"listen" env:"SERVER_LISTEN"`
+	TLSCert string `yaml:"tls_cert" env:"SERVER_TLS_CERT"`
+	TLSKey  string `yaml:"tls_key" env:"SERVER_TLS_KEY"`
+	// ClientCA verifies agent certificates, the certificate has to be issued for the hostname of the report
+	ClientCA string `yaml:"client_ca" env:"SERVER_CLIENT_CA"`
+	// TokensFile holds a "hostname token" pair per line
+	TokensFile string `yaml:"tokens_file" env:"SERVER_TOKENS_FILE"`
+	// StatusToken is required as bearer token for the host status if set
+	StatusToken string `yaml:"status_token" env:"SERVER_STATUS_TOKEN" secret:"true"`
+	// Workers is the number of hosts synced to NetBox at the same time
+	Workers int `yaml:"workers" env:"SERVER_WORKERS"`
+}
+
+// Duration is a time.Duration written as "1h30m" in the config file.
+type Duration time.Duration
+
+// UnmarshalYAML parses a duration string.
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	parsed, err := time.ParseDuration(value.Value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalYAML renders the duration as a string.
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+// SigningConfig holds the settings of signed reports written by export and checked by import.
+type SigningConfig struct {
+	// Key is the ed25519 private key of the host, it is generated on the first export
+	Key string `yaml:"key" env:"SIGNING_KEY"`
+	// CustomField is the device custom field holding the public key
+	CustomField string `yaml:"custom_field" env:"SIGNING_CUSTOM_FIELD"`
+}
+
+// HooksConfig holds the commands run around collection and sync, and the webhook receiving the changes.
+// The commands run with /bin/sh -c, an empty command is disabled.
+type HooksConfig struct {
+	// PreCollect runs before the inventory is collected, the run stops if it fails
+	PreCollect string `yaml:"pre_collect" env:"HOOK_PRE_COLLECT"`
+	// PostCollect gets the report on stdin, it vetoes the run by failing and replaces the report by printing one
+	PostCollect string `yaml:"post_collect" env:"HOOK_POST_COLLECT"`
+	// PostSync gets the change set on stdin after each sync
+	PostSync string `yaml:"post_sync" env:"HOOK_POST_SYNC"`
+	// Timeout limits each hook command and the webhook request
+	Timeout Duration      `yaml:"timeout" env:"HOOK_TIMEOUT"`
+	Webhook WebhookConfig `yaml:"webhook"`
+}
+
+// WebhookConfig is an HTTP endpoint the change set of a sync is posted to, disabled if URL is empty.
+type WebhookConfig struct {
+	URL string `yaml:"url" env:"WEBHOOK_URL"`
+	// Secret is the key of the HMAC-SHA256 signature sent with each request
+	Secret string `yaml:"secret" env:"WEBHOOK_SECRET" secret:"true"`
+}
+
+// LogConfig holds the logging settings.
+type LogConfig struct {
+	Level  string `yaml:"level" env:"LOG_LEVEL"`
+	Format string `yaml:"format" env:"LOG_FORMAT"`
+	Output string `yaml:"output" env:"LOG_OUTPUT"`
+}
+
+var validDeviceNaming = map[string]bool{"hostname": true, "short": true, "serial": true}
+
+// CredentialPath returns the file of the token credential if systemd passed it to the agent, otherwise an empty string.
+func (c NetBoxConfig) CredentialPath() string {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" || c.TokenCredential == "" {
+		return ""
+	}
+	path := filepath.Join(dir, c.TokenCredential)
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// TLSVersions are the accepted values of netbox.tls_min_version
+var TLSVersions = map[string]uint16{"1.0": tls.VersionTLS10, "1.1": tls.VersionTLS11, "1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13}
+
+var validLogFormat = map[string]bool{"text": true, "json": true}
+
+var validLogOutput = map[string]bool{"stdout": true, "stderr": true, "syslog": true, "journald": true}
+
+var validGuestStatus = map[string]bool{"offline": true, "active": true, "planned": true, "staged": true, "failed": true, "decommissioning": true}
+
+var validClusterKind = map[string]bool{"libvirt": true, "proxmox": true, "kubernetes": true}
+
+// Default returns the built-in configuration, it matches the behaviour of the agent without a config file.
+func Default() *Config {
+	return &Config{
+		Resolution: ResolutionConfig{
+			Site: SiteConfig{HostnameRegex: `^[^.]+\.([^.]+)`},
+			Role: ObjectConfig{Name: "default device role", Slug: "default-device-role"},
+		},
+		Collectors: CollectorsConfig{
+			Memory:     true,
+			CPU:        true,
+			IPMI:       true,
+			Chassis:    true,
+			System:     true,
+			Storage:    true,
+			Libvirt:    LibvirtConfig{Enabled: true, UndefinedStatus: "offline"},
+			Proxmox:    ProxmoxConfig{Enabled: true, UndefinedStatus: "offline"},
+			Kubernetes: KubernetesConfig{Enabled: true},
+			// Guests need their host in their cluster, so the hypervisor clusters come first
+			ClusterPrecedence: []string{"proxmox", "libvirt", "kubernetes"},
+			PluginDir:         "/etc/netbox-agent/collectors.d",
+			Timeout:           Duration(2 * time.Minute),
+		},
+		NetBox: NetBoxConfig{TokenCredential: "netbox-token", TLSMinVersion: "1.2", Proxy: "env", Timeout: Duration(30 * time.Second)},
+		Naming: NamingConfig{Device: "hostname"},
+		Sync: SyncConfig{
+			CreateSite:     true,
+			CreateRole:     true,
+			Chassis:        true,
+			InventoryItems: true,
+			BmcInterface:   true,
+			OwnerTag:       "netbox-agent",
+		},
+		Daemon: DaemonConfig{
+			Interval: Duration(time.Hour),
+			Splay:    Duration(time.Hour),
+		},
+		HTTP:     HTTPConfig{CacheTTL: Duration(5 * time.Minute), MinRefresh: Duration(time.Minute)},
+		Server:   ServerConfig{Listen: ":8443", Workers: 2},
+		Signing:  SigningConfig{Key: "/var/lib/netbox-agent/report.key", CustomField: "report_public_key"},
+		Hooks:    HooksConfig{Timeout: Duration(time.Minute)},
+		Log:      LogConfig{Level: "info", Format: "text", Output: "stdout"},
+		LockFile: "/run/netbox-agent.lock",
+	}
+}
+
+// Load builds the configuration from the defaults, the file at path and the environment.
+// A missing file is only an error if required is set.
+func Load(path string, required bool) (*Config, error) {
+	cfg := Default()
+
+	if err := cfg.loadFile(path, required); err != nil {
+		return nil, err
+	}
+	if err := applyEnv(reflect.ValueOf(cfg).Elem()); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (cfg *Config) loadFile(path string, required bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !required {
+			return nil
+		}
+		return fmt.Errorf("error reading config: %v", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error parsing %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// applyEnv overrides fields tagged with env from the environment.
+func applyEnv(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field); err != nil {
+				return err
+			}
+			continue
+		}
+
+		key := t.Field(i).Tag.Get("env")
+		if key == "" {
+			continue
+		}
+		value, ok := os.LookupEnv(key)
+		if !ok || value == "" {
+			continue
+		}
+		if err := setValue(field, value); err != nil {
+			return fmt.Errorf("invalid %s: %v", key, err)
+		}
+	}
+
+	return nil
+}
+
+// setValue parses value into a string, bool, int, duration or string slice field.
+func setValue(field reflect.Value, value string) error {
+	if field.Type() == reflect.TypeOf(Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Kind())
+	}
+
+	return nil
+}
+
+// Set overrides a single field by its dotted yaml path, e.g. "netbox.url".
+// It is used to apply command line flags on top of the file and environment.
+func (cfg *Config) Set(path, value string) error {
+	v := reflect.ValueOf(cfg).Elem()
+
+	for _, name := range strings.Split(path, ".") {
+		if v.Kind() != reflect.Struct {
+			return fmt.Errorf("unknown config key %s", path)
+		}
+		found := false
+		for i := 0; i < v.NumField(); i++ {
+			if strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0] == name {
+				v = v.Field(i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown config key %s", path)
+		}
+	}
+
+	return setValue(v, value)
+}
+
+// Validate checks the configuration for values the agent can't work with.
+// The NetBox connection is checked separately by ValidateNetBox, collecting works without it.
+func (cfg *Config) Validate() error {
+	var errs []string
+
+	if cfg.Resolution.Site.Name == "" && cfg.Resolution.Site.HostnameRegex == "" {
+		errs = append(errs, "resolution.site needs a name or a hostname_regex")
+	}
+	if cfg.Resolution.Site.HostnameRegex != "" {
+		if re, err := regexp.Compile(cfg.Resolution.Site.HostnameRegex); err != nil {
+			errs = append(errs, fmt.Sprintf("resolution.site.hostname_regex: %v", err))
+		} else if re.NumSubexp() < 1 {
+			errs = append(errs, "resolution.site.hostname_regex needs a capture group")
+		}
+	}
+	if cfg.Resolution.Role.Name == "" {
+		errs = append(errs, "resolution.role.name is required")
+	}
+	if !validDeviceNaming[cfg.Naming.Device] {
+		errs = append(errs, fmt.Sprintf("naming.device must be one of hostname, short, serial, got %q", cfg.Naming.Device))
+	}
+	if !validGuestStatus[cfg.Collectors.Libvirt.UndefinedStatus] {
+		errs = append(errs, fmt.Sprintf("collectors.libvirt.undefined_status: invalid status %q", cfg.Collectors.Libvirt.UndefinedStatus))
+	}
+	if !validGuestStatus[cfg.Collectors.Proxmox.UndefinedStatus] {
+		errs = append(errs, fmt.Sprintf("collectors.proxmox.undefined_status: invalid status %q", cfg.Collectors.Proxmox.UndefinedStatus))
+	}
+	for _, kind := range cfg.Collectors.ClusterPrecedence {
+		if !validClusterKind[kind] {
+			errs = append(errs, fmt.Sprintf("collectors.cluster_precedence: must be libvirt, proxmox or kubernetes, got %q", kind))
+		}
+	}
+	if cfg.Collectors.Timeout <= 0 {
+		errs = append(errs, "collectors.timeout must be positive")
+	}
+	if cfg.Hooks.Timeout <= 0 {
+		errs = append(errs, "hooks.timeout must be positive")
+	}
+	if cfg.Hooks.Webhook.URL != "" {
+		if u, err := url.Parse(cfg.Hooks.Webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Sprintf("hooks.webhook.url must be an http or https URL, got %q", cfg.Hooks.Webhook.URL))
+		}
+		if cfg.Hooks.Webhook.Secret == "" {
+			errs = append(errs, "hooks.webhook.secret is required with hooks.webhook.url")
+		}
+	}
+	if cfg.Output.Textfile != "" && !strings.HasSuffix(cfg.Output.Textfile, ".prom") {
+		errs = append(errs, "output.textfile must end with .prom")
+	}
+	if cfg.Daemon.Interval <= 0 {
+		errs = append(errs, "daemon.interval must be positive")
+	}
+	if cfg.Daemon.Splay < 0 || cfg.Daemon.Splay > cfg.Daemon.Interval {
+		errs = append(errs, "daemon.splay must be between 0 and daemon.interval")
+	}
+	if !validLogFormat[cfg.Log.Format] {
+		errs = append(errs, fmt.Sprintf("log.format must be text or json, got %q", cfg.Log.Format))
+	}
+	if !validLogOutput[cfg.Log.Output] {
+		errs = append(errs, fmt.Sprintf("log.output must be one of stdout, stderr, syslog, journald, got %q", cfg.Log.Output))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// NetBoxTargets returns the NetBox instances to sync to.
+// Without targets the top level netbox and sync sections form a single target named default.
+func (cfg *Config) NetBoxTargets() []TargetConfig {
+	if len(cfg.Targets) == 0 {
+		return []TargetConfig{{Name: "default", Mode: "sync", NetBox: cfg.NetBox, Sync: cfg.Sync}}
+	}
+	return cfg.Targets
+}
+
+// ValidateNetBox checks the settings needed to talk to NetBox.
+func (cfg *Config) ValidateNetBox() error {
+	var errs []string
+
+	if len(cfg.Targets) == 0 {
+		errs = validateNetBox("netbox", cfg.NetBox)
+	}
+
+	names := map[string]bool{}
+	for i, t := range cfg.Targets {
+		if t.Name == "" {
+			errs = append(errs, fmt.Sprintf("targets[%d] needs a name", i))
+			continue
+		}
+		if names[t.Name] {
+			errs = append(errs, fmt.Sprintf("target %s is defined twice", t.Name))
+		}
+		names[t.Name] = true
+		if t.Mode != "sync" && t.Mode != "plan" {
+			errs = append(errs, fmt.Sprintf("targets.%s.mode must be sync or plan, got %q", t.Name, t.Mode))
+		}
+		errs = append(errs, validateNetBox("targets."+t.Name+".netbox", t.NetBox)...)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func validateNetBox(prefix string, c NetBoxConfig) []string {
+	var errs []string
+
+	if c.URL == "" {
+		errs = append(errs, prefix+".url is required")
+	}
+	if c.Token == "" && c.TokenFile == "" && c.TokenCommand == "" && c.CredentialPath() == "" {
+		errs = append(errs, prefix+".token, token_file, token_command or a systemd credential is required")
+	}
+	if _, ok := TLSVersions[c.TLSMinVersion]; !ok {
+		errs = append(errs, fmt.Sprintf("%s.tls_min_version must be one of 1.0, 1.1, 1.2, 1.3, got %q", prefix, c.TLSMinVersion))
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, prefix+".tls_cert and tls_key go together")
+	}
+	if c.Proxy != "env" && c.Proxy != "none" {
+		if u, err := url.Parse(c.Proxy); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Sprintf("%s.proxy must be a URL, env or none, got %q", prefix, c.Proxy))
+		}
+	}
+	if c.Timeout <= 0 {
+		errs = append(errs, prefix+".timeout must be positive")
+	}
+	return errs
+}
+
+// ValidateServer checks the settings of the server command.
+func (cfg *Config) ValidateServer() error {
+	var errs []string
+
+	if cfg.Server.Listen == "" {
+		errs = append(errs, "server.listen is required")
+	}
+	if cfg.Server.TLSCert == "" || cfg.Server.TLSKey == "" {
+		errs = append(errs, "server.tls_cert and server.tls_key are required")
+	}
+	if cfg.Server.ClientCA == "" && cfg.Server.TokensFile == "" {
+		errs = append(errs, "server needs a client_ca or a tokens_file to authenticate agents")
+	}
+	if cfg.Server.Workers < 1 {
+		errs = append(errs, "server.workers must be at least 1")
+	}
+	// Devices are named after the authenticated hostname, a serial in the report could name any device
+	if cfg.Naming.Device == "serial" {
+		errs = append(errs, "naming.device serial can't be used by the server, agents are authenticated by hostname")
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Redact returns a copy of the config with all secrets replaced.
+func (cfg *Config) Redact() *Config {
+	redacted := *cfg
+	redactSecrets(reflect.ValueOf(&redacted).Elem())
+	return &redacted
+}
+
+func redactSecrets(v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			redactSecrets(field)
+			continue
+		}
+		if field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct {
+			// The copy shares the slice with the original config, redact a copy of it
+			redacted := reflect.MakeSlice(field.Type(), field.Len(), field.Len())
+			reflect.Copy(redacted, field)
+			for j := 0; j < redacted.Len(); j++ {
+				redactSecrets(redacted.Index(j))
+			}
+			field.Set(redacted)
+			continue
+		}
+		if t.Field(i).Tag.Get("secret") != "true" {
+			continue
+		}
+		switch {
+		case field.Kind() == reflect.String && field.String() != "":
+			field.SetString(Redacted)
+		case field.Kind() == reflect.Map && field.Len() > 0:
+			// The copy shares the map with the original config, replace it
+			redacted := reflect.MakeMap(field.Type())
+			for _, key := range field.MapKeys() {
+				redacted.SetMapIndex(key, reflect.ValueOf(Redacted))
+			}
+			field.Set(redacted)
+		}
+	}
+}
+
+// String renders the config as YAML with secrets redacted.
+func (cfg *Config) String() string {
+	data, err := yaml.Marshal(cfg.Redact())
+	if err != nil {
+		return fmt.Sprintf("error marshalling config: %v", err)
+	}
+	return string(data)
+}
@@ -0,0 +1,122 @@
+package dmidecode
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/yumaojun03/dmidecode/parser/baseboard"
+	"github.com/yumaojun03/dmidecode/smbios"
+)
+
+// BaseboardInfo holds the details of a baseboard (SMBIOS type 2).
+type BaseboardInfo struct {
+	// Handle identifies the board in the SMBIOS table, other structures refer to it
+	Handle            uint16 `json:"handle"`
+	Manufacturer      string `json:"manufacturer"`
+	ProductName       string `json:"product_name"`
+	Version           string `json:"version"`
+	SerialNumber      string `json:"serial_number"`
+	AssetTag          string `json:"asset_tag"`
+	LocationInChassis string `json:"location_in_chassis"`
+	BoardType         string `json:"board_type"`
+	// ChassisHandle is the handle of the chassis the board is in
+	ChassisHandle uint16 `json:"chassis_handle"`
+	// ContainedHandles are the handles of the structures on the board, e.g. processors and daughter boards
+	ContainedHandles []uint16 `json:"contained_handles,omitempty"`
+}
+
+// boardTypes names the board types 01h to 0Dh
+var boardTypes = [...]string{
+	"Unknown",
+	"Other",
+	"Server Blade",
+	"Connectivity Switch",
+	"System Management Module",
+	"Processor Module",
+	"I/O Module",
+	"Memory Module",
+	"Daughter Board",
+	"Motherboard",
+	"Processor+Memory Module",
+	"Processor+I/O Module",
+	"Interconnect Board",
+}
+
+// Baseboards returns the baseboard information as a list.
+func (t *Table) Baseboards() ([]BaseboardInfo, error) {
+	var boards []BaseboardInfo
+	for _, s := range t.dmi.ofType(smbios.BaseBoard) {
+		info, err := baseboard.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+
+		// Extract only the first part of Manufacturer (before space)
+		manufacturerParts := strings.Split(info.Manufacturer, " ")
+		manufacturer := manufacturerParts[0]
+
+		board := BaseboardInfo{
+			Handle:            s.Header.Handle,
+			Manufacturer:      manufacturer,
+			ProductName:       info.ProductName,
+			Version:           info.Version,
+			SerialNumber:      info.SerialNumber,
+			AssetTag:          info.AssetTag,
+			LocationInChassis: info.LocationInChassis,
+			BoardType:         boardTypes[0],
+		}
+
+		// The parser leaves out the handles, offsets count from the end of the 4 byte header.
+		// 07h chassis handle, 09h board type, 0Ah number of contained handles, then the handles.
+		data := s.Formatted
+		if len(data) >= 0x09 {
+			board.ChassisHandle = binary.LittleEndian.Uint16(data[0x07:0x09])
+		}
+		if len(data) >= 0x0a && data[0x09] >= 1 && int(data[0x09]) <= len(boardTypes) {
+			board.BoardType = boardTypes[data[0x09]-1]
+		}
+		if len(data) >= 0x0b {
+			for i := 0; i < int(data[0x0a]) && len(data) >= 0x0b+2*i+2; i++ {
+				board.ContainedHandles = append(board.ContainedHandles, binary.LittleEndian.Uint16(data[0x0b+2*i:]))
+			}
+		}
+
+		boards = append(boards, board)
+	}
+
+	return boards, nil
+}
+
+// mainBoard returns the board the system is built on, ok is false if the table has no baseboard.
+// It is a board no other board contains; among several such boards one in a chassis of the table that is a
+// motherboard or server blade is preferred, then the first in table order.
+func (t *Table) mainBoard(boards []BaseboardInfo) (board BaseboardInfo, ok bool) {
+	contained := map[uint16]bool{}
+	for _, b := range boards {
+		for _, handle := range b.ContainedHandles {
+			contained[handle] = true
+		}
+	}
+	chassis := map[uint16]bool{}
+	for _, s := range t.dmi.ofType(smbios.Chassis) {
+		chassis[s.Header.Handle] = true
+	}
+
+	best := -1
+	for _, b := range boards {
+		if contained[b.Handle] {
+			continue
+		}
+		score := 0
+		if chassis[b.ChassisHandle] {
+			score++
+		}
+		if b.BoardType == "Motherboard" || b.BoardType == "Server Blade" {
+			score += 2
+		}
+		if score > best {
+			board, ok, best = b, true, score
+		}
+	}
+	return board, ok
+}
@@ -0,0 +1,51 @@
+package dmidecode
+
+import (
+	"fmt"
+
+	"github.com/yumaojun03/dmidecode/parser/bios"
+	"github.com/yumaojun03/dmidecode/smbios"
+)
+
+// BIOSInfo holds the details of the BIOS (SMBIOS type 0).
+type BIOSInfo struct {
+	Vendor      string `json:"vendor"`
+	Version     string `json:"version"`
+	ReleaseDate string `json:"release_date"`
+	// Revision is the major and minor release of the system BIOS, e.g. "2.13", empty if the BIOS doesn't report it
+	Revision string `json:"revision,omitempty"`
+	// FirmwareRevision is the release of the embedded controller firmware, empty if there is none
+	FirmwareRevision string `json:"firmware_revision,omitempty"`
+}
+
+// BIOS returns the BIOS information as a list.
+func (t *Table) BIOS() ([]BIOSInfo, error) {
+	var biosList []BIOSInfo
+	for _, s := range t.dmi.ofType(smbios.BIOS) {
+		info, err := bios.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+
+		// The parser leaves out the release bytes at offsets 14h to 17h of SMBIOS 2.4 and later
+		biosList = append(biosList, BIOSInfo{
+			Vendor:           info.Vendor,
+			Version:          info.BIOSVersion,
+			ReleaseDate:      info.ReleaseDate,
+			Revision:         release(s, 0x14),
+			FirmwareRevision: release(s, 0x16),
+		})
+	}
+
+	return biosList, nil
+}
+
+// release returns the major.minor release at offset of the structure, FFh means the release isn't supported
+func release(s *smbios.Structure, offset int) string {
+	// Offsets count from the start of the structure, the formatted area follows the 4 byte header
+	i := offset - 4
+	if len(s.Formatted) < i+2 || s.Formatted[i] == 0xff {
+		return ""
+	}
+	return fmt.Sprintf("%d.%d", s.Formatted[i], s.Formatted[i+1])
+}
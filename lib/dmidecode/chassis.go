@@ -2,8 +2,6 @@ package dmidecode
 
 import (
 	"strings"
-
-	"github.com/yumaojun03/dmidecode"
 )
 
 // ChassisInfo holds the details of the chassis.
@@ -14,15 +12,10 @@ type ChassisInfo struct {
 	Manufacturer string `json:"manufacturer"`
 }
 
-// GetChassisInfo fetches and returns the chassis information as a list.
-func GetChassisInfo() ([]ChassisInfo, error) {
-	dmi, err := dmidecode.New()
-	if err != nil {
-		return nil, err
-	}
-
+// Chassis returns the chassis information as a list.
+func (t *Table) Chassis() ([]ChassisInfo, error) {
 	// Fetch chassis information
-	chassisInfo, err := dmi.Chassis()
+	chassisInfo, err := t.dmi.Chassis()
 	if err != nil {
 		return nil, err
 	}
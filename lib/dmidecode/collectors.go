@@ -0,0 +1,67 @@
+package dmidecode
+
+import (
+	"context"
+
+	"github.com/iglov/netbox-agent/lib/collector"
+)
+
+// Collectors of the SMBIOS table, the collectors of one collection share the table
+var (
+	MemoryCollector = collector.New("memory", func(ctx context.Context) ([]MemoryDeviceInfo, error) {
+		t, err := sharedTable(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return t.MemoryDevices()
+	})
+	CPUCollector = collector.New("cpu", func(ctx context.Context) ([]CPUInfo, error) {
+		t, err := sharedTable(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return t.Processors()
+	})
+	ChassisCollector = collector.New("chassis", func(ctx context.Context) ([]ChassisInfo, error) {
+		t, err := sharedTable(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return t.Chassis()
+	})
+	SystemCollector = collector.New("system", func(ctx context.Context) ([]SystemInfo, error) {
+		t, err := sharedTable(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return t.System()
+	})
+	BaseboardCollector = collector.New("baseboard", func(ctx context.Context) ([]BaseboardInfo, error) {
+		t, err := sharedTable(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return t.Baseboards()
+	})
+	BIOSCollector = collector.New("bios", func(ctx context.Context) ([]BIOSInfo, error) {
+		t, err := sharedTable(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return t.BIOS()
+	})
+)
+
+func init() {
+	collector.Register(MemoryCollector)
+	collector.Register(CPUCollector)
+	collector.Register(ChassisCollector)
+	collector.Register(SystemCollector)
+	collector.Register(BaseboardCollector)
+	collector.Register(BIOSCollector)
+}
+
+// sharedTable returns the SMBIOS table of the collection ctx belongs to, it is read by the first collector
+func sharedTable(ctx context.Context) (*Table, error) {
+	return collector.Cached(ctx, "smbios", ReadTable)
+}
@@ -1,7 +1,6 @@
 package dmidecode
 
 import (
-	"github.com/yumaojun03/dmidecode"
 	"strings"
 )
 
@@ -14,15 +13,10 @@ type CPUInfo struct {
 	ThreadCount       uint8  `json:"thread_count"`
 }
 
-// GetCPUInfo fetches and returns the CPU information as a list.
-func GetCPUInfo() ([]CPUInfo, error) {
-	dmi, err := dmidecode.New()
-	if err != nil {
-		return nil, err
-	}
-
+// Processors returns the CPU information as a list.
+func (t *Table) Processors() ([]CPUInfo, error) {
 	// Fetch processor information
-	cpuInfo, err := dmi.Processor()
+	cpuInfo, err := t.dmi.Processor()
 	if err != nil {
 		return nil, err
 	}
@@ -3,12 +3,13 @@ package dmidecode
 import (
 	"strings"
 
-	"github.com/yumaojun03/dmidecode"
+	"github.com/yumaojun03/dmidecode/parser/memory"
 )
 
 // MemoryDeviceInfo holds the details of a memory device.
 type MemoryDeviceInfo struct {
-	Size          uint16 `json:"size"`
+	Size          uint16 `json:"size"`    // GB, rounded down
+	SizeMB        uint32 `json:"size_mb"` // Exact size in MB
 	FormFactor    string `json:"form_factor"`
 	Speed         uint16 `json:"speed"`
 	Type          string `json:"type"`
@@ -19,15 +20,10 @@ type MemoryDeviceInfo struct {
 	DeviceLocator string `json:"device_locator"`
 }
 
-// GetMemoryDevices fetches and returns the memory device information as a list.
-func GetMemoryDevices() ([]MemoryDeviceInfo, error) {
-	dmi, err := dmidecode.New()
-	if err != nil {
-		return nil, err
-	}
-
+// MemoryDevices returns the installed memory devices as a list.
+func (t *Table) MemoryDevices() ([]MemoryDeviceInfo, error) {
 	// Fetch memory devices information
-	memDevices, err := dmi.MemoryDevice()
+	memDevices, err := t.dmi.MemoryDevice()
 	if err != nil {
 		return nil, err
 	}
@@ -44,8 +40,10 @@ func GetMemoryDevices() ([]MemoryDeviceInfo, error) {
 		partNumber := strings.TrimSpace(device.PartNumber)
 
 		// Add the device to the list
+		size := sizeMB(device)
 		memoryDevices = append(memoryDevices, MemoryDeviceInfo{
-			Size:          device.Size / 1024, // To Gbs
+			Size:          uint16(size / 1024), // To Gbs
+			SizeMB:        size,
 			FormFactor:    device.FormFactor.String(),
 			Speed:         device.Speed,
 			Type:          device.Type.String(),
@@ -59,3 +57,16 @@ func GetMemoryDevices() ([]MemoryDeviceInfo, error) {
 
 	return memoryDevices, nil
 }
+
+// sizeMB returns the size of the memory device in MB
+func sizeMB(device *memory.MemoryDevice) uint32 {
+	switch {
+	case device.Size == 0x7fff:
+		// Devices of 32 GB and more give their size in MB in the extended size
+		return device.ExtendedSize & 0x7fffffff
+	case device.Size&0x8000 != 0:
+		// The size is given in KB
+		return uint32(device.Size&0x7fff) / 1024
+	}
+	return uint32(device.Size)
+}
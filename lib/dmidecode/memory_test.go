@@ -0,0 +1,28 @@
+package dmidecode
+
+import (
+	"testing"
+
+	"github.com/yumaojun03/dmidecode/parser/memory"
+)
+
+func TestSizeMB(t *testing.T) {
+	tests := []struct {
+		name   string
+		device memory.MemoryDevice
+		want   uint32
+	}{
+		{"MB", memory.MemoryDevice{Size: 512}, 512},
+		{"GB module", memory.MemoryDevice{Size: 16384}, 16384},
+		{"KB granularity", memory.MemoryDevice{Size: 0x8000 | 2048}, 2},
+		{"extended size", memory.MemoryDevice{Size: 0x7fff, ExtendedSize: 65536}, 65536},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sizeMB(&tt.device); got != tt.want {
+				t.Errorf("sizeMB() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
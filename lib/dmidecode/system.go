@@ -2,8 +2,6 @@ package dmidecode
 
 import (
 	"strings"
-
-	"github.com/yumaojun03/dmidecode"
 )
 
 // SystemInfo holds the details of the system.
@@ -15,38 +13,32 @@ type SystemInfo struct {
 	LocationInChassis string `json:"location_in_chassis"`
 }
 
-// GetSystemInfo fetches and returns the system and baseboard information.
-func GetSystemInfo() ([]SystemInfo, error) {
-	dmi, err := dmidecode.New()
-	if err != nil {
-		return nil, err
-	}
-
+// System returns the system information, with the location in the chassis of its main board.
+func (t *Table) System() ([]SystemInfo, error) {
 	// Fetch system information
-	systemInfo, err := dmi.System()
+	systemInfo, err := t.dmi.System()
 	if err != nil {
 		return nil, err
 	}
 
 	// Fetch baseboard information (for LocationInChassis)
-	baseboardInfo, err := dmi.BaseBoard()
+	boards, err := t.Baseboards()
 	if err != nil {
 		return nil, err
 	}
+	// The system structure refers to no board, the main board is found by the handles of the boards
+	locationInChassis := ""
+	if board, ok := t.mainBoard(boards); ok {
+		locationInChassis = board.LocationInChassis
+	}
 
-	// Convert system and baseboard information to SystemInfo structs
+	// Convert system information to SystemInfo structs
 	var systemList []SystemInfo
-	for i, sys := range systemInfo {
+	for _, sys := range systemInfo {
 		// Extract only the first part of Manufacturer (before space)
 		manufacturerParts := strings.Split(sys.Manufacturer, " ")
 		manufacturer := manufacturerParts[0]
 
-		// Get the location_in_chassis from the baseboard information (we assume the baseboard corresponds to the system index)
-		locationInChassis := ""
-		if i < len(baseboardInfo) {
-			locationInChassis = baseboardInfo[i].LocationInChassis
-		}
-
 		systemList = append(systemList, SystemInfo{
 			Manufacturer:      manufacturer,
 			ProductName:       sys.ProductName,
@@ -0,0 +1,70 @@
+package dmidecode
+
+import (
+	"github.com/yumaojun03/dmidecode/parser/chassis"
+	"github.com/yumaojun03/dmidecode/parser/memory"
+	"github.com/yumaojun03/dmidecode/parser/processor"
+	"github.com/yumaojun03/dmidecode/parser/system"
+	"github.com/yumaojun03/dmidecode/smbios"
+)
+
+// Table is the SMBIOS table of the host, it is read and decoded once and shared by the getters.
+// The getters only read the decoded structures, they can be called concurrently.
+type Table struct {
+	dmi decoder
+}
+
+// ReadTable reads and decodes the SMBIOS table.
+func ReadTable() (*Table, error) {
+	_, structures, err := smbios.ReadStructures()
+	if err != nil {
+		return nil, err
+	}
+	return &Table{dmi: decoder{structures: structures}}, nil
+}
+
+// decoder parses the structures of the table with the parsers of the dmidecode library.
+// Unlike the decoder of the library it keeps the raw structures, for the fields the parsers leave out.
+type decoder struct {
+	structures []*smbios.Structure
+}
+
+// ofType returns the raw structures of type typ in table order
+func (d decoder) ofType(typ smbios.StructureType) []*smbios.Structure {
+	var found []*smbios.Structure
+	for _, s := range d.structures {
+		if smbios.StructureType(s.Header.Type) == typ {
+			found = append(found, s)
+		}
+	}
+	return found
+}
+
+func (d decoder) System() ([]*system.Information, error) {
+	return parseAll(d.ofType(smbios.System), system.Parse)
+}
+
+func (d decoder) Chassis() ([]*chassis.Information, error) {
+	return parseAll(d.ofType(smbios.Chassis), chassis.Parse)
+}
+
+func (d decoder) Processor() ([]*processor.Processor, error) {
+	return parseAll(d.ofType(smbios.Processor), processor.ParseProcessor)
+}
+
+func (d decoder) MemoryDevice() ([]*memory.MemoryDevice, error) {
+	return parseAll(d.ofType(smbios.MemoryDevice), memory.ParseMemoryDevice)
+}
+
+// parseAll parses every structure with parse
+func parseAll[T any](structures []*smbios.Structure, parse func(*smbios.Structure) (*T, error)) ([]*T, error) {
+	infos := make([]*T, 0, len(structures))
+	for _, s := range structures {
+		info, err := parse(s)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
@@ -1,12 +1,21 @@
 package ipmi
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"os"
 
+	"github.com/iglov/netbox-agent/lib/collector"
 	"github.com/u-root/u-root/pkg/ipmi"
 )
 
+// devicePath is the IPMI device opened by ipmi.Open(0)
+const devicePath = "/dev/ipmi0"
+
+// ErrNotPresent is returned if the host has no IPMI device, e.g. a VM without a BMC
+var ErrNotPresent = errors.New("no IPMI device " + devicePath)
+
 type BmcInfo struct {
 	DeviceID  string `json:"deviceID"`
 	DeviceRev string `json:"deviceRevision"`
@@ -26,10 +35,37 @@ func Check(f func() error) {
 	}
 }
 
-func GetBmcInfo() BmcInfo {
+// BmcCollector collects the BMC details, hosts without an IPMI device skip it
+var BmcCollector = collector.New("ipmi", func(context.Context) (BmcInfo, error) {
+	return GetBmcInfo()
+}).When(func() (bool, string) {
+	return IsPresent(), ErrNotPresent.Error()
+})
+
+func init() {
+	collector.Register(BmcCollector)
+}
+
+// IsPresent reports whether the host has an IPMI device
+func IsPresent() bool {
+	_, err := os.Stat(devicePath)
+	return err == nil
+}
+
+func GetBmcInfo() (BmcInfo, error) {
 	bmc := BmcInfo{}
-	laninfo := LanConfig()
-	devinfo := DeviceInfo()
+	if !IsPresent() {
+		return bmc, ErrNotPresent
+	}
+
+	laninfo, err := LanConfig()
+	if err != nil {
+		return bmc, err
+	}
+	devinfo, err := DeviceInfo()
+	if err != nil {
+		return bmc, err
+	}
 
 	bmc.Ipaddr = laninfo["ipaddress"]
 	bmc.Subnet = laninfo["subnetmask"]
@@ -41,10 +77,10 @@ func GetBmcInfo() BmcInfo {
 	bmc.ManID = devinfo["manufacturerID"]
 	bmc.ProdID = devinfo["productID"]
 
-	return bmc
+	return bmc, nil
 }
 
-func LanConfig() map[string]string {
+func LanConfig() (map[string]string, error) {
 	netMap := make(map[string]string)
 
 	const (
@@ -59,7 +95,7 @@ func LanConfig() map[string]string {
 
 	ipmi, err := ipmi.Open(0)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("error opening IPMI device: %v", err)
 	}
 	defer Check(ipmi.Close)
 
@@ -69,7 +105,7 @@ func LanConfig() map[string]string {
 
 	// ip address
 	if ipaddress, err := ipmi.GetLanConfig(1, IPAddress); err != nil {
-		log.Panic("Could not get an IP address.")
+		return nil, fmt.Errorf("error reading BMC IP address: %v", err)
 	} else {
 		if len(ipaddress) == 6 {
 			netMap["ipaddress"] = fmt.Sprintf("%d.%d.%d.%d", ipaddress[2], ipaddress[3], ipaddress[4], ipaddress[5])
@@ -79,7 +115,7 @@ func LanConfig() map[string]string {
 	}
 	// MAC address
 	if macaddress, err := ipmi.GetLanConfig(1, MACAddress); err != nil {
-		log.Panic("Could not get a MAC address.")
+		return nil, fmt.Errorf("error reading BMC MAC address: %v", err)
 	} else {
 		if len(macaddress) == 8 {
 			netMap["macaddress"] = fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", macaddress[2], macaddress[3], macaddress[4], macaddress[5], macaddress[6], macaddress[7])
@@ -89,7 +125,7 @@ func LanConfig() map[string]string {
 	}
 	// subnet mask
 	if subnetmask, err := ipmi.GetLanConfig(1, SubnetMask); err != nil {
-		log.Panic("Could not get a Subnet Mask.")
+		return nil, fmt.Errorf("error reading BMC subnet mask: %v", err)
 	} else {
 		if len(subnetmask) == 6 {
 			netMap["subnetmask"] = fmt.Sprintf("%d.%d.%d.%d", subnetmask[2], subnetmask[3], subnetmask[4], subnetmask[5])
@@ -98,21 +134,21 @@ func LanConfig() map[string]string {
 		}
 	}
 
-	return netMap
+	return netMap, nil
 }
 
-func DeviceInfo() map[string]string {
+func DeviceInfo() (map[string]string, error) {
 
 	devMap := make(map[string]string)
 
 	ipmi, err := ipmi.Open(0)
 	if err != nil {
-		fmt.Printf("Failed to open ipmi device: %v\n", err)
+		return nil, fmt.Errorf("error opening IPMI device: %v", err)
 	}
 	defer Check(ipmi.Close)
 
 	if info, err := ipmi.GetDeviceID(); err != nil {
-		fmt.Printf("Failed to get device ID information: %v\n", err)
+		return nil, fmt.Errorf("error reading BMC device ID: %v", err)
 	} else {
 		devMap["deviceID"] = fmt.Sprintf("%d", info.DeviceID)
 		devMap["deviceRevision"] = fmt.Sprintf("%d", (info.DeviceRevision & 0x0F))
@@ -134,5 +170,5 @@ func DeviceInfo() map[string]string {
 		devMap["productID"] = fmt.Sprintf("%d (0x%04X)", pid, pid)
 	}
 
-	return devMap
+	return devMap, nil
 }
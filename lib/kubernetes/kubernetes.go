@@ -0,0 +1,279 @@
+package kubernetes
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Default locations of the kubelet configuration
+var (
+	KubeletConfig     = "/var/lib/kubelet/config.yaml"
+	KubeletKubeconfig = "/etc/kubernetes/kubelet.conf"
+	KubeletFlagFiles  = []string{"/var/lib/kubelet/kubeadm-flags.env", "/etc/default/kubelet", "/etc/sysconfig/kubelet"}
+)
+
+// NodeInfo holds the details of the Kubernetes node running on this host.
+type NodeInfo struct {
+	ClusterName string            `json:"cluster_name"`
+	NodeName    string            `json:"node_name"`
+	Server      string            `json:"server,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	// LabelsErr is why the labels could not be read from the API server, the kubelet flags are used then
+	LabelsErr error `json:"-"`
+}
+
+// Options override what is detected from the kubelet configuration.
+type Options struct {
+	ClusterName string
+	NodeName    string
+	Kubeconfig  string
+}
+
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+var nodeLabelsFlag = regexp.MustCompile(`--node-labels[= ]([^\s"']+)`)
+
+// IsPresent reports whether a kubelet is configured on this host.
+func IsPresent() bool {
+	_, err := os.Stat(KubeletConfig)
+	return err == nil
+}
+
+// GetNodeInfo detects the cluster and node this host belongs to.
+// Labels are read from the Node object through the kubelet credentials, the
+// --node-labels kubelet flag is used when the API server can't be reached.
+func GetNodeInfo(opts Options) (NodeInfo, error) {
+	info := NodeInfo{
+		ClusterName: opts.ClusterName,
+		NodeName:    opts.NodeName,
+	}
+
+	configPath := opts.Kubeconfig
+	if configPath == "" {
+		configPath = KubeletKubeconfig
+	}
+
+	var kc *kubeconfig
+	if data, err := os.ReadFile(configPath); err == nil {
+		kc = &kubeconfig{}
+		if err := yaml.Unmarshal(data, kc); err != nil {
+			return info, fmt.Errorf("error parsing %s: %v", configPath, err)
+		}
+	}
+
+	if info.ClusterName == "" {
+		info.ClusterName = detectClusterName(kc)
+	}
+	if info.ClusterName == "" {
+		return info, fmt.Errorf("unable to detect cluster name, set it explicitly")
+	}
+
+	if info.NodeName == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return info, err
+		}
+		// kubelet defaults to the lowercase hostname
+		info.NodeName = strings.ToLower(hostname)
+	}
+
+	info.Labels = flagNodeLabels()
+	if kc != nil {
+		labels, server, err := fetchNodeLabels(kc, path.Dir(configPath), info.NodeName)
+		info.Server = server
+		if err == nil {
+			info.Labels = labels
+		} else {
+			info.LabelsErr = err
+		}
+	}
+
+	return info, nil
+}
+
+// detectClusterName returns the cluster of the kubeconfig current-context.
+func detectClusterName(kc *kubeconfig) string {
+	if kc == nil {
+		return ""
+	}
+	for _, ctx := range kc.Contexts {
+		if ctx.Name == kc.CurrentContext {
+			return ctx.Context.Cluster
+		}
+	}
+	if len(kc.Clusters) > 0 {
+		return kc.Clusters[0].Name
+	}
+	return ""
+}
+
+// flagNodeLabels reads --node-labels from the kubelet flag files.
+func flagNodeLabels() map[string]string {
+	labels := map[string]string{}
+
+	for _, name := range KubeletFlagFiles {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		for _, match := range nodeLabelsFlag.FindAllStringSubmatch(string(data), -1) {
+			for _, label := range strings.Split(match[1], ",") {
+				if key, value, ok := strings.Cut(label, "="); ok {
+					labels[key] = value
+				}
+			}
+		}
+	}
+
+	return labels
+}
+
+// fetchNodeLabels reads the labels of the Node object from the API server.
+func fetchNodeLabels(kc *kubeconfig, baseDir, nodeName string) (map[string]string, string, error) {
+	contextCluster, contextUser := "", ""
+	for _, ctx := range kc.Contexts {
+		if ctx.Name == kc.CurrentContext {
+			contextCluster, contextUser = ctx.Context.Cluster, ctx.Context.User
+		}
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	server := ""
+	for _, cl := range kc.Clusters {
+		if cl.Name != contextCluster && contextCluster != "" {
+			continue
+		}
+		server = cl.Cluster.Server
+		ca, err := readData(cl.Cluster.CertificateAuthorityData, cl.Cluster.CertificateAuthority, baseDir)
+		if err != nil {
+			return nil, server, err
+		}
+		if len(ca) > 0 {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			tlsConfig.RootCAs.AppendCertsFromPEM(ca)
+		}
+		break
+	}
+	if server == "" {
+		return nil, "", fmt.Errorf("no API server in kubeconfig")
+	}
+
+	token := ""
+	for _, u := range kc.Users {
+		if u.Name != contextUser && contextUser != "" {
+			continue
+		}
+		cert, err := readData(u.User.ClientCertificateData, u.User.ClientCertificate, baseDir)
+		if err != nil {
+			return nil, server, err
+		}
+		key, err := readData(u.User.ClientKeyData, u.User.ClientKey, baseDir)
+		if err != nil {
+			return nil, server, err
+		}
+		if len(cert) > 0 && len(key) > 0 {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, server, err
+			}
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+		token = u.User.Token
+		if token == "" && u.User.TokenFile != "" {
+			data, err := readData("", u.User.TokenFile, baseDir)
+			if err != nil {
+				return nil, server, err
+			}
+			token = strings.TrimSpace(string(data))
+		}
+		break
+	}
+
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(server, "/")+"/api/v1/nodes/"+url.PathEscape(nodeName), nil)
+	if err != nil {
+		return nil, server, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, server, err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, server, fmt.Errorf("error fetching node %s: %s", nodeName, res.Status)
+	}
+
+	var node struct {
+		Metadata struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&node); err != nil {
+		return nil, server, err
+	}
+
+	return node.Metadata.Labels, server, nil
+}
+
+// readData returns inline base64 data or the content of a file relative to the kubeconfig.
+func readData(data, file, baseDir string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file == "" {
+		return nil, nil
+	}
+	if !path.IsAbs(file) {
+		file = path.Join(baseDir, file)
+	}
+	return os.ReadFile(file)
+}
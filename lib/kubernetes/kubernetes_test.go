@@ -0,0 +1,191 @@
+package kubernetes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// useFlagFiles points the package at the kubelet flag files under testdata
+func useFlagFiles(t *testing.T, names ...string) {
+	flagFiles := KubeletFlagFiles
+	t.Cleanup(func() { KubeletFlagFiles = flagFiles })
+
+	KubeletFlagFiles = names
+}
+
+// apiServer serves the node worker1 to requests with the token of testdata/token
+func apiServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer node-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/api/v1/nodes/worker1" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`{"metadata":{"name":"worker1","labels":{"topology.kubernetes.io/zone":"b","kubernetes.io/os":"linux"}}}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// kubeconfigFor writes testdata/kubelet.conf with the server of srv to a temporary directory
+func kubeconfigFor(t *testing.T, srv *httptest.Server) string {
+	data, err := os.ReadFile("testdata/kubelet.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := os.ReadFile("testdata/token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(path.Join(dir, "token"), token, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	name := path.Join(dir, "kubelet.conf")
+	if err := os.WriteFile(name, []byte(strings.ReplaceAll(string(data), "SERVER", srv.URL)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestGetNodeInfo(t *testing.T) {
+	useFlagFiles(t, "testdata/kubeadm-flags.env", "testdata/kubelet.default", "testdata/missing")
+	srv := apiServer(t)
+
+	tests := []struct {
+		name    string
+		opts    Options
+		want    NodeInfo
+		wantErr bool
+		// wantLabelsErr is set if the labels of the API server can't be read
+		wantLabelsErr bool
+	}{
+		{
+			name: "labels of the node object",
+			opts: Options{NodeName: "worker1", Kubeconfig: kubeconfigFor(t, srv)},
+			want: NodeInfo{
+				ClusterName: "prod",
+				NodeName:    "worker1",
+				Server:      srv.URL,
+				Labels:      map[string]string{"topology.kubernetes.io/zone": "b", "kubernetes.io/os": "linux"},
+			},
+		},
+		{
+			name:          "unknown node falls back to the kubelet flags",
+			wantLabelsErr: true,
+			opts:          Options{ClusterName: "override", NodeName: "worker2", Kubeconfig: kubeconfigFor(t, srv)},
+			want: NodeInfo{
+				ClusterName: "override",
+				NodeName:    "worker2",
+				Server:      srv.URL,
+				Labels:      map[string]string{"topology.kubernetes.io/zone": "a", "node-role": "worker", "nvidia.com/gpu.product": "A100"},
+			},
+		},
+		{
+			name:          "missing client certificate falls back to the kubelet flags",
+			wantLabelsErr: true,
+			opts:          Options{NodeName: "worker1", Kubeconfig: "testdata/kubelet-cert.conf"},
+			want: NodeInfo{
+				ClusterName: "prod",
+				NodeName:    "worker1",
+				Server:      "https://prod.example.com:6443",
+				Labels:      map[string]string{"topology.kubernetes.io/zone": "a", "node-role": "worker", "nvidia.com/gpu.product": "A100"},
+			},
+		},
+		{
+			name: "no kubeconfig",
+			opts: Options{ClusterName: "bare", NodeName: "worker1", Kubeconfig: "testdata/missing.conf"},
+			want: NodeInfo{
+				ClusterName: "bare",
+				NodeName:    "worker1",
+				Labels:      map[string]string{"topology.kubernetes.io/zone": "a", "node-role": "worker", "nvidia.com/gpu.product": "A100"},
+			},
+		},
+		{
+			name:    "no kubeconfig and no cluster name",
+			opts:    Options{NodeName: "worker1", Kubeconfig: "testdata/missing.conf"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid kubeconfig",
+			opts:    Options{NodeName: "worker1", Kubeconfig: "testdata/kubeadm-flags.env"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := GetNodeInfo(tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetNodeInfo() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if (info.LabelsErr != nil) != tt.wantLabelsErr {
+				t.Errorf("LabelsErr = %v, want error %v", info.LabelsErr, tt.wantLabelsErr)
+			}
+			info.LabelsErr = nil
+			if !reflect.DeepEqual(info, tt.want) {
+				t.Errorf("GetNodeInfo() =\n%+v\nwant\n%+v", info, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectClusterName(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want string
+	}{
+		{"current context", "testdata/kubelet.conf", "prod"},
+		{"single context", "testdata/kubelet-cert.conf", "prod"},
+		{"unknown current context", "testdata/kubelet-nocontext.conf", "edge"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kc := readKubeconfig(t, tt.file)
+			if got := detectClusterName(kc); got != tt.want {
+				t.Errorf("detectClusterName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if got := detectClusterName(nil); got != "" {
+		t.Errorf("detectClusterName(nil) = %q, want empty", got)
+	}
+}
+
+func TestFetchNodeLabelsNoServer(t *testing.T) {
+	kc := readKubeconfig(t, "testdata/kubelet-nocontext.conf")
+	kc.Clusters = nil
+
+	if _, _, err := fetchNodeLabels(kc, "testdata", "worker1"); err == nil {
+		t.Error("fetchNodeLabels() without a cluster succeeded")
+	}
+}
+
+func readKubeconfig(t *testing.T, name string) *kubeconfig {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kc := &kubeconfig{}
+	if err := yaml.Unmarshal(data, kc); err != nil {
+		t.Fatal(err)
+	}
+	return kc
+}
@@ -0,0 +1,306 @@
+package libvirt
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ConfigDirs are the locations libvirt keeps qemu domain definitions in.
+// Persistent definitions live in /etc, running (and transient) ones in /run.
+var ConfigDirs = []string{"/etc/libvirt/qemu", "/run/libvirt/qemu"}
+
+// Warnf logs the domain files that are skipped, the agent points it at its logger
+var Warnf = func(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+}
+
+// DomainInfo holds the details of a libvirt guest.
+type DomainInfo struct {
+	Name       string          `json:"name"`
+	UUID       string          `json:"uuid"`
+	VCPU       int             `json:"vcpu"`
+	MemoryMB   int64           `json:"memory_mb"`
+	Running    bool            `json:"running"`
+	Disks      []DiskInfo      `json:"disks,omitempty"`
+	Interfaces []InterfaceInfo `json:"interfaces,omitempty"`
+}
+
+// DiskInfo holds the details of a guest disk.
+type DiskInfo struct {
+	Target string `json:"target"`
+	Source string `json:"source,omitempty"`
+	Format string `json:"format,omitempty"`
+	SizeGB int64  `json:"size_gb"`
+}
+
+// InterfaceInfo holds the details of a guest network interface.
+type InterfaceInfo struct {
+	Name       string `json:"name"`
+	MacAddress string `json:"mac_address"`
+	Bridge     string `json:"bridge,omitempty"`
+	Model      string `json:"model,omitempty"`
+}
+
+// domainXML mirrors the parts of the libvirt domain format we care about.
+// Runtime state files under /run wrap the domain in a <domstatus> element.
+type domainXML struct {
+	Name   string `xml:"name"`
+	UUID   string `xml:"uuid"`
+	VCPU   int    `xml:"vcpu"`
+	Memory struct {
+		Unit  string `xml:"unit,attr"`
+		Value int64  `xml:",chardata"`
+	} `xml:"memory"`
+	Devices struct {
+		Disks []struct {
+			Type   string `xml:"type,attr"`
+			Device string `xml:"device,attr"`
+			Driver struct {
+				Type string `xml:"type,attr"`
+			} `xml:"driver"`
+			Source struct {
+				File string `xml:"file,attr"`
+				Dev  string `xml:"dev,attr"`
+				Pool string `xml:"pool,attr"`
+				Vol  string `xml:"volume,attr"`
+			} `xml:"source"`
+			Target struct {
+				Dev string `xml:"dev,attr"`
+			} `xml:"target"`
+		} `xml:"disk"`
+		Interfaces []struct {
+			Type string `xml:"type,attr"`
+			Mac  struct {
+				Address string `xml:"address,attr"`
+			} `xml:"mac"`
+			Source struct {
+				Bridge  string `xml:"bridge,attr"`
+				Network string `xml:"network,attr"`
+				Dev     string `xml:"dev,attr"`
+			} `xml:"source"`
+			Model struct {
+				Type string `xml:"type,attr"`
+			} `xml:"model"`
+			Alias struct {
+				Name string `xml:"name,attr"`
+			} `xml:"alias"`
+		} `xml:"interface"`
+	} `xml:"devices"`
+}
+
+type domStatusXML struct {
+	State  string    `xml:"state,attr"`
+	Domain domainXML `xml:"domain"`
+}
+
+// IsPresent reports whether this host looks like a libvirt hypervisor.
+func IsPresent() bool {
+	for _, dir := range ConfigDirs {
+		if st, err := os.Stat(dir); err == nil && st.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// GetDomains reads every domain definition found in ConfigDirs.
+func GetDomains() ([]DomainInfo, error) {
+	return ReadDomains(ConfigDirs...)
+}
+
+// ReadDomains parses the domain XML files in the given directories, files that can't be parsed are skipped.
+// Definitions are merged by UUID, so a guest that is both defined and running
+// is reported once and flagged as running.
+func ReadDomains(dirs ...string) ([]DomainInfo, error) {
+	domains := map[string]DomainInfo{}
+
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("error reading %s: %v", dir, err)
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".xml") {
+				continue
+			}
+
+			// A broken definition doesn't hide the other guests
+			domain, err := ReadDomainFile(path.Join(dir, entry.Name()))
+			if err != nil {
+				Warnf("Skipping libvirt domain: %v", err)
+				continue
+			}
+
+			if known, ok := domains[domain.UUID]; ok {
+				// Keep the persistent definition, only take the running flag
+				known.Running = known.Running || domain.Running
+				domains[domain.UUID] = known
+				continue
+			}
+			domains[domain.UUID] = domain
+		}
+	}
+
+	var domainList []DomainInfo
+	for _, domain := range domains {
+		domainList = append(domainList, domain)
+	}
+	sort.Slice(domainList, func(i, j int) bool { return domainList[i].Name < domainList[j].Name })
+
+	return domainList, nil
+}
+
+// ReadDomainFile parses a single domain XML file.
+func ReadDomainFile(name string) (DomainInfo, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return DomainInfo{}, err
+	}
+	defer func() { _ = f.Close() }()
+
+	domain, err := ParseDomain(f)
+	if err != nil {
+		return DomainInfo{}, fmt.Errorf("error parsing %s: %v", name, err)
+	}
+	return domain, nil
+}
+
+// ParseDomain decodes a libvirt domain definition, either a plain <domain>
+// document or a <domstatus> runtime state file.
+func ParseDomain(r io.Reader) (DomainInfo, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return DomainInfo{}, err
+	}
+
+	var dom domainXML
+	running := false
+
+	var status domStatusXML
+	if err := xml.Unmarshal(data, &status); err == nil && status.Domain.UUID != "" {
+		dom = status.Domain
+		running = status.State == "running"
+	} else if err := xml.Unmarshal(data, &dom); err != nil {
+		return DomainInfo{}, err
+	}
+
+	if dom.Name == "" || dom.UUID == "" {
+		return DomainInfo{}, fmt.Errorf("domain has no name or uuid")
+	}
+
+	domain := DomainInfo{
+		Name:     dom.Name,
+		UUID:     strings.ToLower(dom.UUID),
+		VCPU:     dom.VCPU,
+		MemoryMB: toMegabytes(dom.Memory.Value, dom.Memory.Unit),
+		Running:  running,
+	}
+
+	for _, disk := range dom.Devices.Disks {
+		// Skip CD-ROM and floppy drives
+		if disk.Device != "" && disk.Device != "disk" {
+			continue
+		}
+
+		source := disk.Source.File
+		if source == "" {
+			source = disk.Source.Dev
+		}
+		if source == "" && disk.Source.Pool != "" {
+			source = disk.Source.Pool + "/" + disk.Source.Vol
+		}
+
+		domain.Disks = append(domain.Disks, DiskInfo{
+			Target: disk.Target.Dev,
+			Source: source,
+			Format: disk.Driver.Type,
+			SizeGB: diskSize(source) / (1024 * 1024 * 1024),
+		})
+	}
+
+	for i, iface := range dom.Devices.Interfaces {
+		name := iface.Alias.Name
+		if name == "" {
+			name = fmt.Sprintf("net%d", i)
+		}
+
+		bridge := iface.Source.Bridge
+		if bridge == "" {
+			bridge = iface.Source.Network
+		}
+		if bridge == "" {
+			bridge = iface.Source.Dev
+		}
+
+		domain.Interfaces = append(domain.Interfaces, InterfaceInfo{
+			Name:       name,
+			MacAddress: strings.ToLower(iface.Mac.Address),
+			Bridge:     bridge,
+			Model:      iface.Model.Type,
+		})
+	}
+
+	return domain, nil
+}
+
+// toMegabytes converts a libvirt memory value to megabytes, KiB is the default unit.
+func toMegabytes(value int64, unit string) int64 {
+	switch strings.ToLower(unit) {
+	case "b", "bytes":
+		return value / (1024 * 1024)
+	case "", "k", "kib":
+		return value / 1024
+	case "kb":
+		return value * 1000 / (1024 * 1024)
+	case "m", "mib":
+		return value
+	case "mb":
+		return value * 1000 * 1000 / (1024 * 1024)
+	case "g", "gib":
+		return value * 1024
+	case "gb":
+		return value * 1000 * 1000 * 1000 / (1024 * 1024)
+	case "t", "tib":
+		return value * 1024 * 1024
+	case "tb":
+		return value * 1000 * 1000 * 1000 * 1000 / (1024 * 1024)
+	}
+	return value / 1024
+}
+
+// diskSize returns the virtual size of a file backed disk in bytes.
+// qcow2 images report the size from their header, everything else the file size.
+func diskSize(name string) int64 {
+	if name == "" {
+		return 0
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return 0
+	}
+	defer func() { _ = f.Close() }()
+
+	st, err := f.Stat()
+	if err != nil || !st.Mode().IsRegular() {
+		return 0
+	}
+
+	// qcow2 header: magic "QFI\xfb" at offset 0, virtual size at offset 24
+	header := make([]byte, 32)
+	if _, err := io.ReadFull(f, header); err == nil && string(header[:4]) == "QFI\xfb" {
+		return int64(binary.BigEndian.Uint64(header[24:32]))
+	}
+
+	return st.Size()
+}
@@ -0,0 +1,160 @@
+package libvirt
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadDomains(t *testing.T) {
+	var warnings []string
+	warnf := Warnf
+	t.Cleanup(func() { Warnf = warnf })
+	Warnf = func(format string, args ...interface{}) { warnings = append(warnings, fmt.Sprintf(format, args...)) }
+
+	domains, err := ReadDomains("testdata/etc", "testdata/run", "testdata/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The broken files are skipped, the other domains are read
+	if len(warnings) != 2 || !strings.Contains(warnings[0], "broken.xml") || !strings.Contains(warnings[1], "nouuid.xml") {
+		t.Errorf("warnings = %q, want broken.xml and nouuid.xml", warnings)
+	}
+
+	want := []DomainInfo{
+		{
+			Name:     "batch",
+			UUID:     "9f1b2c3d-4e5f-4a6b-8c7d-0e1f2a3b4c5d",
+			VCPU:     1,
+			MemoryMB: 1024,
+		},
+		{
+			Name:     "db",
+			UUID:     "0c9e1d7a-53b4-4f0e-8a65-2d4b3e1f7a90",
+			VCPU:     4,
+			MemoryMB: 8192,
+			Disks: []DiskInfo{
+				{Target: "vda", Source: "testdata/raw.img", Format: "raw", SizeGB: 0},
+				{Target: "vdb", Source: "ssd/db-data", Format: "raw", SizeGB: 0},
+				{Target: "vdc", Source: "/dev/nonexistent/db-log", Format: "raw", SizeGB: 0},
+			},
+		},
+		{
+			// The persistent definition is kept, the runtime state only marks it running
+			Name:     "web",
+			UUID:     "6a2f9c1e-0b7d-4e55-9d0a-3c1f2b4a5e60",
+			VCPU:     2,
+			MemoryMB: 4096,
+			Running:  true,
+			Disks: []DiskInfo{
+				{Target: "vda", Source: "testdata/web.qcow2", Format: "qcow2", SizeGB: 20},
+				{Target: "vdb", Format: "raw", SizeGB: 0},
+			},
+			Interfaces: []InterfaceInfo{
+				{Name: "net0", MacAddress: "52:54:00:ab:cd:01", Bridge: "br0", Model: "virtio"},
+				{Name: "net1", MacAddress: "52:54:00:ab:cd:02", Bridge: "default"},
+			},
+		},
+	}
+	if !reflect.DeepEqual(domains, want) {
+		t.Errorf("ReadDomains() =\n%+v\nwant\n%+v", domains, want)
+	}
+}
+
+func TestParseDomain(t *testing.T) {
+	tests := []struct {
+		name        string
+		xml         string
+		wantRunning bool
+		wantMemory  int64
+		wantErr     bool
+	}{
+		{
+			name:       "domain",
+			xml:        `<domain><name>a</name><uuid>u1</uuid><memory unit="MiB">512</memory></domain>`,
+			wantMemory: 512,
+		},
+		{
+			name:        "running domstatus",
+			xml:         `<domstatus state="running"><domain><name>a</name><uuid>u1</uuid><memory>2097152</memory></domain></domstatus>`,
+			wantRunning: true,
+			wantMemory:  2048,
+		},
+		{
+			name:       "paused domstatus",
+			xml:        `<domstatus state="paused"><domain><name>a</name><uuid>u1</uuid><memory unit="G">1</memory></domain></domstatus>`,
+			wantMemory: 1024,
+		},
+		{
+			name:    "no uuid",
+			xml:     `<domain><name>a</name></domain>`,
+			wantErr: true,
+		},
+		{
+			name:    "not xml",
+			xml:     `name: a`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			domain, err := ParseDomain(strings.NewReader(tt.xml))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseDomain() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if domain.Running != tt.wantRunning {
+				t.Errorf("Running = %v, want %v", domain.Running, tt.wantRunning)
+			}
+			if domain.MemoryMB != tt.wantMemory {
+				t.Errorf("MemoryMB = %d, want %d", domain.MemoryMB, tt.wantMemory)
+			}
+		})
+	}
+}
+
+func TestToMegabytes(t *testing.T) {
+	tests := []struct {
+		value int64
+		unit  string
+		want  int64
+	}{
+		{4194304, "", 4096},
+		{4194304, "KiB", 4096},
+		{1073741824, "bytes", 1024},
+		{2048, "MiB", 2048},
+		{1000, "MB", 953},
+		{4, "GiB", 4096},
+		{1, "TiB", 1048576},
+		{4194304, "unknown", 4096},
+	}
+
+	for _, tt := range tests {
+		if got := toMegabytes(tt.value, tt.unit); got != tt.want {
+			t.Errorf("toMegabytes(%d, %q) = %d, want %d", tt.value, tt.unit, got, tt.want)
+		}
+	}
+}
+
+func TestDiskSize(t *testing.T) {
+	tests := []struct {
+		name string
+		want int64
+	}{
+		{"testdata/web.qcow2", 20 << 30},
+		{"testdata/raw.img", 4096},
+		{"testdata/missing.img", 0},
+		{"testdata", 0},
+		{"", 0},
+	}
+
+	for _, tt := range tests {
+		if got := diskSize(tt.name); got != tt.want {
+			t.Errorf("diskSize(%q) = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
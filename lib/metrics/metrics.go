@@ -0,0 +1,168 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Labels of a single series
+type Labels map[string]string
+
+// Metric types of the Prometheus text format
+const (
+	Counter = "counter"
+	Gauge   = "gauge"
+)
+
+// Registry holds metric families and writes them in the Prometheus text exposition format.
+// It is safe for concurrent use.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+type family struct {
+	help   string
+	typ    string
+	series map[string]float64
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*family{}}
+}
+
+// Describe registers a metric family, it has to be called before values are set.
+func (r *Registry) Describe(name, typ, help string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.families[name]; !ok {
+		r.families[name] = &family{help: help, typ: typ, series: map[string]float64{}}
+	}
+}
+
+// Set sets the value of a gauge series.
+func (r *Registry) Set(name string, labels Labels, value float64) {
+	r.update(name, labels, func(float64) float64 { return value })
+}
+
+// Add adds delta to a counter series.
+func (r *Registry) Add(name string, labels Labels, delta float64) {
+	r.update(name, labels, func(old float64) float64 { return old + delta })
+}
+
+// Reset drops all series of a family, e.g. before facts of a new collection are set.
+func (r *Registry) Reset(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if f, ok := r.families[name]; ok {
+		f.series = map[string]float64{}
+	}
+}
+
+func (r *Registry) update(name string, labels Labels, f func(float64) float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fam, ok := r.families[name]
+	if !ok {
+		panic(fmt.Sprintf("metric %s is not described", name))
+	}
+	key := formatLabels(labels)
+	fam.series[key] = f(fam.series[key])
+}
+
+// WriteText writes all families in the text exposition format, sorted by name and labels.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		fam := r.families[name]
+		if len(fam.series) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(bw, "# HELP %s %s\n", name, escapeHelp(fam.help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, fam.typ)
+
+		keys := make([]string, 0, len(fam.series))
+		for key := range fam.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			fmt.Fprintf(bw, "%s%s %s\n", name, key, formatValue(fam.series[key]))
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Handler serves the registry for Prometheus scrapes.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = r.WriteText(w)
+	})
+}
+
+// formatLabels renders labels as {a="1",b="2"}, sorted by name.
+func formatLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, name+`="`+escapeValue(labels[name])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var valueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeValue(value string) string {
+	return valueEscaper.Replace(value)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
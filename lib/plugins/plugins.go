@@ -0,0 +1,172 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/iglov/netbox-agent/lib/collector"
+)
+
+// Version is the version of the output contract, plugins print it in their result
+const Version = 1
+
+// maxOutput limits what is read from a plugin, a report is not the place for bulk data
+const maxOutput = 1 << 20
+
+// validName is what a plugin name may look like after its extension is cut off
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Result is the JSON document a plugin prints on stdout.
+type Result struct {
+	Version int `json:"version"`
+	// Data holds any facts of the plugin, they are kept in the report as they are
+	Data map[string]interface{} `json:"data,omitempty"`
+	// Items become inventory items of the device
+	Items []Item `json:"items,omitempty"`
+	// CustomFields are set on the device, the fields have to exist in NetBox
+	CustomFields map[string]interface{} `json:"custom_fields,omitempty"`
+}
+
+// Item is an inventory item declared by a plugin.
+type Item struct {
+	Name         string                 `json:"name"`
+	Label        string                 `json:"label,omitempty"`
+	Manufacturer string                 `json:"manufacturer,omitempty"`
+	PartID       string                 `json:"part_id,omitempty"`
+	Serial       string                 `json:"serial,omitempty"`
+	CustomFields map[string]interface{} `json:"custom_fields,omitempty"`
+}
+
+// Find returns a collector for every plugin in dir, a missing dir has none.
+// A plugin is an executable named after its collector, an extension such as .sh is cut off.
+// Files that can be written by others than their owner, or that belong to another user than root or the agent, are
+// skipped and returned as errors.
+func Find(dir string) ([]collector.Collector, []error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, []error{fmt.Errorf("error reading %s: %v", dir, err)}
+	}
+
+	var found []collector.Collector
+	var errs []error
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") || entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+
+		info, err := os.Stat(path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error reading %s: %v", path, err))
+			continue
+		}
+		if !info.Mode().IsRegular() || info.Mode().Perm()&0o111 == 0 {
+			continue
+		}
+		if err := checkOwner(info); err != nil {
+			errs = append(errs, fmt.Errorf("skipping plugin %s: %v", path, err))
+			continue
+		}
+
+		name := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		if !validName.MatchString(name) {
+			errs = append(errs, fmt.Errorf("skipping plugin %s: the name must be lowercase letters, digits, _ and -", path))
+			continue
+		}
+
+		found = append(found, collector.New(name, func(ctx context.Context) (Result, error) {
+			return run(ctx, path)
+		}))
+	}
+
+	sort.Slice(found, func(i, j int) bool { return found[i].Name() < found[j].Name() })
+	return found, errs
+}
+
+// checkOwner refuses plugins that someone else than root or the agent could have put there
+func checkOwner(info os.FileInfo) error {
+	if info.Mode().Perm()&0o022 != 0 {
+		return fmt.Errorf("writable by group or others")
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Uid != 0 && int(st.Uid) != os.Geteuid() {
+		return fmt.Errorf("owned by uid %d", st.Uid)
+	}
+	return nil
+}
+
+// run runs the plugin at path and parses its result, the plugin and its children are killed when ctx is done
+func run(ctx context.Context, path string) (Result, error) {
+	var result Result
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Stdout = &limitedBuffer{buf: &stdout, limit: maxOutput + 1}
+	cmd.Stderr = &limitedBuffer{buf: &stderr, limit: 4096}
+	// The plugin runs in a process group of its own, so anything it started is killed with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	// Don't wait for children that keep stdout open after the kill
+	cmd.WaitDelay = time.Second
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return result, fmt.Errorf("error running %s: %v", path, ctx.Err())
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return result, fmt.Errorf("error running %s: %v: %s", path, err, msg)
+		}
+		return result, fmt.Errorf("error running %s: %v", path, err)
+	}
+	if stdout.Len() > maxOutput {
+		return result, fmt.Errorf("output of %s is larger than %d bytes", path, maxOutput)
+	}
+
+	decoder := json.NewDecoder(&stdout)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&result); err != nil {
+		return result, fmt.Errorf("error parsing the output of %s: %v", path, err)
+	}
+	if result.Version != Version {
+		return result, fmt.Errorf("output of %s has version %d, expected %d", path, result.Version, Version)
+	}
+	for i, item := range result.Items {
+		if item.Name == "" {
+			return result, fmt.Errorf("item %d of %s has no name", i, path)
+		}
+	}
+	return result, nil
+}
+
+// limitedBuffer keeps the first limit bytes written to it and drops the rest
+type limitedBuffer struct {
+	buf   *bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); room > 0 {
+		if len(p) > room {
+			b.buf.Write(p[:room])
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
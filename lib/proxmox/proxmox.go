@@ -0,0 +1,377 @@
+package proxmox
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Locations of the Proxmox VE cluster filesystem and runtime state
+var (
+	PveDir       = "/etc/pve"
+	QemuRunDir   = "/run/qemu-server"
+	LxcCgroupDir = "/sys/fs/cgroup/lxc"
+)
+
+// Warnf logs the guest configs that are skipped, the agent points it at its logger
+var Warnf = func(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+}
+
+// ClusterInfo holds the details of a Proxmox VE cluster.
+type ClusterInfo struct {
+	Name  string   `json:"name"`
+	Nodes []string `json:"nodes"`
+}
+
+// GuestInfo holds the details of a Proxmox VE virtual machine or container.
+type GuestInfo struct {
+	VMID       int             `json:"vmid"`
+	Type       string          `json:"type"` // qemu or lxc
+	Node       string          `json:"node"`
+	Name       string          `json:"name"`
+	Cores      int             `json:"cores"`
+	MemoryMB   int64           `json:"memory_mb"`
+	Template   bool            `json:"template"`
+	Running    bool            `json:"running"`
+	Disks      []DiskInfo      `json:"disks,omitempty"`
+	Interfaces []InterfaceInfo `json:"interfaces,omitempty"`
+}
+
+// DiskInfo holds the details of a guest disk or mount point.
+type DiskInfo struct {
+	Name   string `json:"name"`
+	Volume string `json:"volume"`
+	SizeGB int64  `json:"size_gb"`
+}
+
+// InterfaceInfo holds the details of a guest network interface.
+type InterfaceInfo struct {
+	Name       string `json:"name"`
+	MacAddress string `json:"mac_address,omitempty"`
+	Bridge     string `json:"bridge,omitempty"`
+	Model      string `json:"model,omitempty"`
+	VlanTag    string `json:"vlan_tag,omitempty"`
+}
+
+var (
+	// EFI vars and TPM state are volumes of a few MB, not disks of the guest
+	qemuDiskKey = regexp.MustCompile(`^(ide|sata|scsi|virtio|unused)\d+$`)
+	lxcDiskKey  = regexp.MustCompile(`^(rootfs|mp\d+)$`)
+	netKey      = regexp.MustCompile(`^net\d+$`)
+)
+
+// IsPresent reports whether this host is a Proxmox VE node.
+func IsPresent() bool {
+	st, err := os.Stat(path.Join(PveDir, "nodes"))
+	return err == nil && st.IsDir()
+}
+
+// LocalNode returns the name of this node.
+// /etc/pve/local links to nodes/<name>, the short hostname is used if it is missing.
+func LocalNode() (string, error) {
+	if target, err := os.Readlink(path.Join(PveDir, "local")); err == nil {
+		return path.Base(target), nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	return strings.Split(hostname, ".")[0], nil
+}
+
+// GetClusterInfo reads the cluster name and members from corosync.conf.
+// A standalone node has no corosync.conf, in that case nil is returned.
+func GetClusterInfo() (*ClusterInfo, error) {
+	f, err := os.Open(path.Join(PveDir, "corosync.conf"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	return ParseCorosync(f)
+}
+
+// ParseCorosync parses a corosync.conf file.
+func ParseCorosync(r io.Reader) (*ClusterInfo, error) {
+	cluster := &ClusterInfo{}
+	var sections []string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasSuffix(line, "{") {
+			sections = append(sections, strings.TrimSpace(strings.TrimSuffix(line, "{")))
+			continue
+		}
+		if line == "}" {
+			if len(sections) > 0 {
+				sections = sections[:len(sections)-1]
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		switch strings.Join(sections, ".") {
+		case "totem":
+			if key == "cluster_name" {
+				cluster.Name = value
+			}
+		case "nodelist.node":
+			if key == "name" {
+				cluster.Nodes = append(cluster.Nodes, value)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if cluster.Name == "" {
+		return nil, fmt.Errorf("no cluster_name in corosync totem section")
+	}
+	return cluster, nil
+}
+
+// GetGuests reads the qemu-server and lxc configs of all nodes, configs that can't be read are skipped.
+func GetGuests() ([]GuestInfo, error) {
+	nodesDir := path.Join(PveDir, "nodes")
+	nodes, err := os.ReadDir(nodesDir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", nodesDir, err)
+	}
+
+	var guests []GuestInfo
+	for _, node := range nodes {
+		if !node.IsDir() {
+			continue
+		}
+
+		for _, guestType := range []string{"qemu", "lxc"} {
+			confDir := path.Join(nodesDir, node.Name(), "qemu-server")
+			if guestType == "lxc" {
+				confDir = path.Join(nodesDir, node.Name(), "lxc")
+			}
+
+			confs, err := os.ReadDir(confDir)
+			if err != nil {
+				continue
+			}
+
+			for _, conf := range confs {
+				vmid, err := strconv.Atoi(strings.TrimSuffix(conf.Name(), ".conf"))
+				if err != nil || !strings.HasSuffix(conf.Name(), ".conf") {
+					continue
+				}
+
+				// A broken config doesn't hide the other guests
+				guest, err := ReadGuestFile(path.Join(confDir, conf.Name()), guestType)
+				if err != nil {
+					Warnf("Skipping Proxmox VE guest %d: %v", vmid, err)
+					continue
+				}
+				guest.VMID = vmid
+				guest.Node = node.Name()
+				guest.Running = isRunning(guestType, vmid)
+				if guest.Name == "" {
+					guest.Name = fmt.Sprintf("%s-%d", guestType, vmid)
+				}
+
+				guests = append(guests, guest)
+			}
+		}
+	}
+
+	sort.Slice(guests, func(i, j int) bool { return guests[i].VMID < guests[j].VMID })
+	return guests, nil
+}
+
+// ReadGuestFile parses a single qemu-server or lxc config file.
+func ReadGuestFile(name, guestType string) (GuestInfo, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return GuestInfo{}, err
+	}
+	defer func() { _ = f.Close() }()
+
+	guest, err := ParseGuestConfig(f, guestType)
+	if err != nil {
+		return GuestInfo{}, fmt.Errorf("error parsing %s: %v", name, err)
+	}
+	return guest, nil
+}
+
+// ParseGuestConfig parses the current section of a guest config, snapshots are ignored.
+func ParseGuestConfig(r io.Reader, guestType string) (GuestInfo, error) {
+	guest := GuestInfo{Type: guestType}
+	sockets, cores, vcpus := 1, 0, 0
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// Snapshot sections follow the current config
+		if strings.HasPrefix(line, "[") {
+			break
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		switch {
+		case key == "name" || key == "hostname":
+			guest.Name = value
+		case key == "cores":
+			cores, _ = strconv.Atoi(value)
+		case key == "sockets":
+			sockets, _ = strconv.Atoi(value)
+		case key == "vcpus":
+			vcpus, _ = strconv.Atoi(value)
+		case key == "memory":
+			guest.MemoryMB, _ = strconv.ParseInt(value, 10, 64)
+		case key == "template":
+			guest.Template = value == "1"
+		case guestType == "qemu" && qemuDiskKey.MatchString(key), guestType == "lxc" && lxcDiskKey.MatchString(key):
+			volume, options := splitOptions(value)
+			if options["media"] == "cdrom" {
+				continue
+			}
+			guest.Disks = append(guest.Disks, DiskInfo{
+				Name:   key,
+				Volume: volume,
+				SizeGB: parseSize(options["size"]),
+			})
+		case netKey.MatchString(key):
+			guest.Interfaces = append(guest.Interfaces, parseNet(key, value, guestType))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return GuestInfo{}, err
+	}
+
+	guest.Cores = cores * sockets
+	if cores == 0 && guestType == "qemu" {
+		guest.Cores = sockets
+	}
+	if vcpus > 0 {
+		guest.Cores = vcpus
+	}
+
+	return guest, nil
+}
+
+// parseNet parses a netN option string.
+// qemu uses "virtio=MAC,bridge=vmbr0", lxc uses "name=eth0,hwaddr=MAC,bridge=vmbr0".
+func parseNet(key, value, guestType string) InterfaceInfo {
+	iface := InterfaceInfo{Name: key}
+
+	for _, option := range strings.Split(value, ",") {
+		k, v, _ := strings.Cut(option, "=")
+		switch k {
+		case "bridge":
+			iface.Bridge = v
+		case "tag":
+			iface.VlanTag = v
+		case "hwaddr":
+			iface.MacAddress = strings.ToLower(v)
+		case "name":
+			if guestType == "lxc" {
+				iface.Name = v
+			}
+		case "type":
+			iface.Model = v
+		case "e1000", "e1000e", "virtio", "rtl8139", "vmxnet3", "i82551", "i82557b", "i82559er", "ne2k_isa", "ne2k_pci", "pcnet":
+			iface.Model = k
+			iface.MacAddress = strings.ToLower(v)
+		}
+	}
+
+	return iface
+}
+
+// splitOptions splits "volume,key=value,..." into the volume and its options.
+func splitOptions(value string) (string, map[string]string) {
+	parts := strings.Split(value, ",")
+	options := map[string]string{}
+	volume := ""
+
+	for i, part := range parts {
+		k, v, ok := strings.Cut(part, "=")
+		if !ok {
+			if i == 0 {
+				volume = part
+			}
+			continue
+		}
+		if i == 0 && k == "volume" {
+			volume = v
+			continue
+		}
+		options[k] = v
+	}
+
+	return volume, options
+}
+
+// parseSize converts a Proxmox size such as "32G" or "512M" to whole gigabytes.
+func parseSize(size string) int64 {
+	if size == "" {
+		return 0
+	}
+
+	unit := size[len(size)-1]
+	number, err := strconv.ParseFloat(strings.TrimRight(size, "KMGTkmgt"), 64)
+	if err != nil {
+		return 0
+	}
+
+	switch unit {
+	case 'K', 'k':
+		number /= 1024 * 1024
+	case 'M', 'm':
+		number /= 1024
+	case 'T', 't':
+		number *= 1024
+	case 'G', 'g':
+	default:
+		number /= 1024 * 1024 * 1024
+	}
+
+	return int64(number)
+}
+
+// isRunning checks the runtime state of a guest on this node.
+func isRunning(guestType string, vmid int) bool {
+	statePath := path.Join(QemuRunDir, fmt.Sprintf("%d.pid", vmid))
+	if guestType == "lxc" {
+		statePath = path.Join(LxcCgroupDir, strconv.Itoa(vmid))
+	}
+	_, err := os.Stat(statePath)
+	return err == nil
+}
@@ -0,0 +1,191 @@
+package proxmox
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// useTestdata points the package at the fixtures under testdata
+func useTestdata(t *testing.T) {
+	pveDir, qemuRunDir, lxcCgroupDir := PveDir, QemuRunDir, LxcCgroupDir
+	t.Cleanup(func() { PveDir, QemuRunDir, LxcCgroupDir = pveDir, qemuRunDir, lxcCgroupDir })
+
+	PveDir, QemuRunDir, LxcCgroupDir = "testdata/pve", "testdata/run/qemu-server", "testdata/cgroup/lxc"
+}
+
+func TestLocalNode(t *testing.T) {
+	useTestdata(t)
+
+	node, err := LocalNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node != "pve1" {
+		t.Errorf("LocalNode() = %q, want pve1", node)
+	}
+}
+
+func TestGetClusterInfo(t *testing.T) {
+	useTestdata(t)
+
+	cluster, err := GetClusterInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ClusterInfo{Name: "lab", Nodes: []string{"pve1", "pve2"}}
+	if !reflect.DeepEqual(cluster, want) {
+		t.Errorf("GetClusterInfo() = %+v, want %+v", cluster, want)
+	}
+
+	// A standalone node has no corosync.conf
+	PveDir = t.TempDir()
+	if cluster, err := GetClusterInfo(); cluster != nil || err != nil {
+		t.Errorf("GetClusterInfo() of a standalone node = %+v, %v, want nil, nil", cluster, err)
+	}
+}
+
+func TestParseCorosync(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    string
+		want    *ClusterInfo
+		wantErr bool
+	}{
+		{
+			name: "single node",
+			conf: "totem {\n  cluster_name: solo\n}\nnodelist {\n  node {\n    name: pve1\n  }\n}\n",
+			want: &ClusterInfo{Name: "solo", Nodes: []string{"pve1"}},
+		},
+		{
+			name: "name outside of a node",
+			conf: "# comment\nname: stray\ntotem {\n  cluster_name: lab\n  interface {\n    cluster_name: nested\n  }\n}\n",
+			want: &ClusterInfo{Name: "lab"},
+		},
+		{
+			name:    "no cluster name",
+			conf:    "nodelist {\n  node {\n    name: pve1\n  }\n}\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster, err := ParseCorosync(strings.NewReader(tt.conf))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseCorosync() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(cluster, tt.want) {
+				t.Errorf("ParseCorosync() = %+v, want %+v", cluster, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetGuests(t *testing.T) {
+	useTestdata(t)
+	var warnings []string
+	warnf := Warnf
+	t.Cleanup(func() { Warnf = warnf })
+	Warnf = func(format string, args ...interface{}) { warnings = append(warnings, fmt.Sprintf(format, args...)) }
+
+	guests, err := GetGuests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The config of 102 can't be read, the other guests are
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "guest 102") {
+		t.Errorf("warnings = %q, want one for guest 102", warnings)
+	}
+
+	want := []GuestInfo{
+		{
+			VMID: 100, Type: "qemu", Node: "pve1", Name: "web", Cores: 4, MemoryMB: 4096, Running: true,
+			Disks: []DiskInfo{
+				{Name: "scsi0", Volume: "local-lvm:vm-100-disk-0", SizeGB: 32},
+				{Name: "scsi1", Volume: "local-lvm:vm-100-disk-1", SizeGB: 0},
+				{Name: "unused0", Volume: "local-lvm:vm-100-disk-5", SizeGB: 0},
+				{Name: "virtio0", Volume: "nfs:100/vm-100-disk-3.qcow2", SizeGB: 0},
+			},
+			Interfaces: []InterfaceInfo{
+				{Name: "net0", MacAddress: "bc:24:11:aa:bb:01", Bridge: "vmbr0", Model: "virtio", VlanTag: "20"},
+				{Name: "net1", MacAddress: "bc:24:11:aa:bb:02", Bridge: "vmbr1", Model: "e1000"},
+			},
+		},
+		{
+			// Stopped template without a name
+			VMID: 101, Type: "qemu", Node: "pve1", Name: "qemu-101", Cores: 3, MemoryMB: 2048, Template: true,
+			Disks: []DiskInfo{{Name: "scsi0", Volume: "ceph:vm-101-disk-0", SizeGB: 1536}},
+		},
+		{
+			VMID: 200, Type: "lxc", Node: "pve1", Name: "dns", Cores: 1, MemoryMB: 512, Running: true,
+			Disks: []DiskInfo{
+				{Name: "mp0", Volume: "local-lvm:vm-200-disk-1", SizeGB: 10},
+				{Name: "rootfs", Volume: "local-lvm:vm-200-disk-0", SizeGB: 8},
+			},
+			Interfaces: []InterfaceInfo{{Name: "eth0", MacAddress: "bc:24:11:cc:dd:01", Bridge: "vmbr0", Model: "veth"}},
+		},
+		{
+			// Runs on another node, its runtime state isn't visible here
+			VMID: 300, Type: "qemu", Node: "pve2", Name: "migrated", Cores: 4, MemoryMB: 8192,
+			Disks: []DiskInfo{{Name: "scsi0", Volume: "local-lvm:vm-300-disk-0", SizeGB: 100}},
+		},
+	}
+	if !reflect.DeepEqual(guests, want) {
+		t.Errorf("GetGuests() =\n%+v\nwant\n%+v", guests, want)
+	}
+}
+
+func TestParseGuestConfigCores(t *testing.T) {
+	tests := []struct {
+		name      string
+		conf      string
+		guestType string
+		want      int
+	}{
+		{"qemu defaults", "memory: 512\n", "qemu", 1},
+		{"qemu sockets only", "sockets: 2\n", "qemu", 2},
+		{"qemu cores and sockets", "cores: 4\nsockets: 2\n", "qemu", 8},
+		{"qemu vcpus", "cores: 4\nsockets: 2\nvcpus: 6\n", "qemu", 6},
+		{"lxc unlimited", "memory: 512\n", "lxc", 0},
+		{"lxc cores", "cores: 2\n", "lxc", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guest, err := ParseGuestConfig(strings.NewReader(tt.conf), tt.guestType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if guest.Cores != tt.want {
+				t.Errorf("Cores = %d, want %d", guest.Cores, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size string
+		want int64
+	}{
+		{"32G", 32},
+		{"32g", 32},
+		{"512M", 0},
+		{"2048M", 2},
+		{"1T", 1024},
+		{"1.5T", 1536},
+		{"4194304K", 4},
+		{"10737418240", 10},
+		{"", 0},
+		{"G", 0},
+		{"large", 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseSize(tt.size); got != tt.want {
+			t.Errorf("parseSize(%q) = %d, want %d", tt.size, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package signing
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Format identifies a signed report file
+const Format = "netbox-agent-signed-report"
+
+// keyPrefix is the prefix of an encoded public key, it leaves room for other algorithms
+const keyPrefix = "ed25519:"
+
+// context is signed together with the payload, so the signature can't be reused for other data
+const context = "netbox-agent report\n"
+
+// Envelope is a payload signed with the ed25519 key of a host
+type Envelope struct {
+	Format    string `json:"format"`
+	Payload   []byte `json:"payload"`
+	PublicKey string `json:"public_key"`
+	Signature []byte `json:"signature"`
+}
+
+// LoadOrCreateKey reads the private key at path, a new key is generated if the file doesn't exist.
+func LoadOrCreateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return parsePrivateKey(path, data)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("error generating key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding key: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("error writing %s: %v", path, err)
+	}
+	// O_EXCL keeps a key written by a concurrent run
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("error writing %s: %v", path, err)
+	}
+	err = pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	// A key that didn't reach the disk completely would be unreadable on the next run
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error writing %s: %v", path, err)
+	}
+	return key, nil
+}
+
+func parsePrivateKey(path string, data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("no private key in %s", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 key", path)
+	}
+	return key, nil
+}
+
+// EncodePublicKey returns the public key as stored in NetBox, e.g. "ed25519:<base64>"
+func EncodePublicKey(key ed25519.PublicKey) string {
+	return keyPrefix + base64.StdEncoding.EncodeToString(key)
+}
+
+// ParsePublicKey parses a key encoded by EncodePublicKey
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	encoded, ok := strings.CutPrefix(strings.TrimSpace(s), keyPrefix)
+	if !ok {
+		return nil, fmt.Errorf("public key must start with %s", keyPrefix)
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key: %d bytes instead of %d", len(key), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Sign wraps the payload into a signed envelope
+func Sign(payload []byte, key ed25519.PrivateKey) *Envelope {
+	return &Envelope{
+		Format:    Format,
+		Payload:   payload,
+		PublicKey: EncodePublicKey(key.Public().(ed25519.PublicKey)),
+		Signature: ed25519.Sign(key, append([]byte(context), payload...)),
+	}
+}
+
+// Verify checks the signature against the trusted key and returns the payload.
+// The key in the envelope is only used to explain a mismatch.
+func (e *Envelope) Verify(trusted ed25519.PublicKey) ([]byte, error) {
+	if e.Format != Format {
+		return nil, fmt.Errorf("not a signed report")
+	}
+	if len(e.Signature) == 0 {
+		return nil, fmt.Errorf("report is not signed")
+	}
+	if embedded, err := ParsePublicKey(e.PublicKey); err == nil && !bytes.Equal(embedded, trusted) {
+		return nil, fmt.Errorf("report is signed by %s, not by the key of the device", e.PublicKey)
+	}
+	if !ed25519.Verify(trusted, append([]byte(context), e.Payload...), e.Signature) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	return e.Payload, nil
+}
@@ -2,14 +2,28 @@ package storage
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
 	"path"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
+
+	"github.com/iglov/netbox-agent/lib/collector"
 )
 
+const megaCli = "/opt/MegaRAID/MegaCli/MegaCli64"
+
+// DiskCollector collects the disks of the host
+var DiskCollector = collector.New("storage", GetStorageInfo)
+
+func init() {
+	collector.Register(DiskCollector)
+}
+
 // DiskInfo represents information about a storage device.
 type DiskInfo struct {
 	Name         string `json:"name,omitempty"`
@@ -22,10 +36,11 @@ type DiskInfo struct {
 }
 
 // GetStorageInfo fetches information about the storage devices, handling both simple disks and RAID setups.
-func GetStorageInfo() ([]DiskInfo, error) {
+// MegaCli is killed when ctx is done.
+func GetStorageInfo(ctx context.Context) ([]DiskInfo, error) {
 	// Check if RAID is present by checking for the existence of MegaCli.
-	if _, err := os.Stat("/opt/MegaRAID/MegaCli/MegaCli64"); err == nil {
-		return getRAIDDiskInfo()
+	if _, err := os.Stat(megaCli); err == nil {
+		return getRAIDDiskInfo(ctx)
 	}
 
 	// If MegaCli is not present, gather simple disk information.
@@ -98,10 +113,21 @@ func getSimpleDiskInfo() ([]DiskInfo, error) {
 }
 
 // getRAIDDiskInfo gathers information from MegaCli for RAID setups.
-func getRAIDDiskInfo() ([]DiskInfo, error) {
+func getRAIDDiskInfo(ctx context.Context) ([]DiskInfo, error) {
 	// Run MegaCli to gather disk information.
-	cmd := exec.Command("/opt/MegaRAID/MegaCli/MegaCli64", "-PDList", "-aALL")
+	cmd := exec.CommandContext(ctx, megaCli, "-PDList", "-aALL")
+	// MegaCli runs in a process group of its own, so anything it started is killed with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	// Don't wait for children that keep stdout open after the kill
+	cmd.WaitDelay = time.Second
+
 	output, err := cmd.Output()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("error running MegaCli: %v", ctx.Err())
+	}
 	if err != nil {
 		return nil, fmt.Errorf("error running MegaCli: %v", err)
 	}
@@ -0,0 +1,69 @@
+package systemd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+)
+
+// JournalSocket receives messages in the journald native protocol
+var JournalSocket = "/run/systemd/journal/socket"
+
+// Journal priorities, the same as the syslog severities
+const (
+	PriErr     = 3
+	PriWarning = 4
+	PriInfo    = 6
+	PriDebug   = 7
+)
+
+// JournalSend sends a message with additional fields to journald.
+// Field names are converted to the upper case form journald accepts.
+func JournalSend(priority int, message string, fields map[string]string) error {
+	var buf bytes.Buffer
+
+	writeField(&buf, "PRIORITY", string(rune('0'+priority)))
+	writeField(&buf, "MESSAGE", message)
+	for name, value := range fields {
+		if name = fieldName(name); name != "" {
+			writeField(&buf, name, value)
+		}
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: JournalSocket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
+
+// writeField writes NAME=value, values with newlines use the length prefixed binary form
+func writeField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		buf.WriteString(name + "=" + value + "\n")
+		return
+	}
+
+	buf.WriteString(name + "\n")
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
+
+// fieldName maps a name to A-Z, 0-9 and _, journald ignores fields starting with _ from clients
+func fieldName(name string) string {
+	mapped := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+	return strings.TrimLeft(mapped, "_0123456789")
+}
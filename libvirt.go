@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/iglov/netbox-agent/lib/libvirt"
+	"github.com/netbox-community/go-netbox/v4"
+)
+
+func init() {
+	libvirt.Warnf = log.Warnf
+}
+
+// syncLibvirt upserts the libvirt guests of this host into a per-host cluster.
+// The guests need their host in the cluster, they are skipped unless member is set.
+func (s *syncer) syncLibvirt(hostname, site string, member bool) {
+	if !libvirt.IsPresent() {
+		log.Debug("libvirt not found, skipping guest inventory")
+		return
+	}
+	if !member {
+		log.Warnf("Device %s is a member of a cluster before libvirt in collectors.cluster_precedence, skipping libvirt guests", hostname)
+		return
+	}
+
+	domains, err := libvirt.GetDomains()
+	if err != nil {
+		s.failCollector("libvirt", "Error fetching libvirt domains", err)
+		return
+	}
+
+	cluster := s.ensureCluster(hostname, "libvirt", site)
+	if cluster == nil {
+		return
+	}
+	s.assignDeviceToCluster(hostname, cluster)
+
+	var guests []guest
+	for _, domain := range domains {
+		guests = append(guests, libvirtGuest(domain))
+	}
+
+	// Guests that are no longer defined on this host get the configured status
+	retiredStatus := netbox.PatchedWritableModuleRequestStatus(s.cfg.Collectors.Libvirt.UndefinedStatus)
+	s.syncGuests(cluster, hostname, guests, nil, retiredStatus)
+}
+
+func libvirtGuest(domain libvirt.DomainInfo) guest {
+	g := guest{
+		Name:     domain.Name,
+		VCPUs:    float64(domain.VCPU),
+		MemoryMB: domain.MemoryMB,
+		Status:   netbox.PATCHEDWRITABLEMODULEREQUESTSTATUS_OFFLINE,
+		Context:  domain,
+	}
+	if domain.Running {
+		g.Status = netbox.PATCHEDWRITABLEMODULEREQUESTSTATUS_ACTIVE
+	}
+
+	for _, disk := range domain.Disks {
+		g.Disks = append(g.Disks, guestDisk{
+			Name:        disk.Target,
+			SizeGB:      disk.SizeGB,
+			Description: disk.Source,
+		})
+	}
+
+	for _, iface := range domain.Interfaces {
+		description := ""
+		if iface.Bridge != "" {
+			description = fmt.Sprintf("Bridge: %s", iface.Bridge)
+		}
+		g.Interfaces = append(g.Interfaces, guestInterface{
+			Name:        iface.Name,
+			MacAddress:  iface.MacAddress,
+			Description: description,
+		})
+	}
+
+	return g
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// instanceLock keeps a second agent from syncing while one runs.
+// The lock is a flock on lock_file, so it goes away with the process that held it.
+// The file holds the pid of the running agent, a pid left by an agent that died is stale.
+type instanceLock struct {
+	path string
+	f    *os.File
+}
+
+// acquireLock takes the lock at path, it fails if another agent holds it.
+// An empty path disables the lock.
+func acquireLock(path string) (*instanceLock, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening lock file: %w", err)
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		pid := lockPID(f)
+		_ = f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("another netbox-agent is running (pid %d, lock file %s)", pid, path)
+		}
+		return nil, fmt.Errorf("error locking %s: %w", path, err)
+	}
+
+	if pid := lockPID(f); pid != 0 && pid != os.Getpid() {
+		log.Warnf("Taking over stale lock file %s of pid %d, which didn't exit cleanly", path, pid)
+	}
+
+	if err := writeLockPID(f, os.Getpid()); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("error writing lock file %s: %w", path, err)
+	}
+
+	return &instanceLock{path: path, f: f}, nil
+}
+
+// release empties the lock file and unlocks it.
+// The file is kept, removing it could remove the lock another agent just took.
+func (l *instanceLock) release() {
+	if l == nil {
+		return
+	}
+	if err := l.f.Truncate(0); err != nil {
+		log.Debugf("Error emptying lock file %s: %s", l.path, err)
+	}
+	// Closing the file drops the flock
+	_ = l.f.Close()
+}
+
+// lockPID returns the pid written to the lock file, 0 if there is none
+func lockPID(f *os.File) int {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0
+	}
+	data, err := io.ReadAll(io.LimitReader(f, 32))
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return pid
+}
+
+func writeLockPID(f *os.File, pid int) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(pid)+"\n"), 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/iglov/netbox-agent/lib/config"
+	"github.com/iglov/netbox-agent/lib/systemd"
+	"github.com/sirupsen/logrus"
+	lsyslog "github.com/sirupsen/logrus/hooks/syslog"
+)
+
+// logStdout is where the stdout log output goes, collect moves it to stderr to keep stdout for the report
+var logStdout io.Writer = os.Stdout
+
+// logContext adds the run id and hostname to every log line
+var logContext = &contextHook{fields: logrus.Fields{}}
+
+// closeLogOutput releases the current log destination, e.g. the syslog connection
+var closeLogOutput = func() {}
+
+// setupLogging applies log.level, log.format and log.output
+func setupLogging(cfg *config.Config) error {
+	level, err := logrus.ParseLevel(strings.ToLower(cfg.Log.Level))
+	if err != nil {
+		return fmt.Errorf("invalid log level: %s", cfg.Log.Level)
+	}
+
+	var formatter logrus.Formatter = &logrus.TextFormatter{}
+	if cfg.Log.Format == "json" {
+		formatter = &logrus.JSONFormatter{}
+	}
+
+	hooks := logrus.LevelHooks{}
+	hooks.Add(logContext)
+
+	out := logStdout
+	closeOutput := func() {}
+	switch cfg.Log.Output {
+	case "stderr":
+		out = os.Stderr
+	case "syslog":
+		hook, err := lsyslog.NewSyslogHook("", "", syslog.LOG_INFO|syslog.LOG_DAEMON, "netbox-agent")
+		if err != nil {
+			return fmt.Errorf("error connecting to syslog: %v", err)
+		}
+		hooks.Add(hook)
+		out = io.Discard
+		closeOutput = func() { _ = hook.Writer.Close() }
+	case "journald":
+		if _, err := os.Stat(systemd.JournalSocket); err != nil {
+			return fmt.Errorf("journald is not available: %v", err)
+		}
+		hooks.Add(journalHook{})
+		out = io.Discard
+	}
+
+	closeLogOutput()
+	closeLogOutput = closeOutput
+
+	if hostname, err := os.Hostname(); err == nil {
+		logContext.set("hostname", hostname)
+	}
+
+	log.SetLevel(level)
+	log.SetFormatter(formatter)
+	log.ReplaceHooks(hooks)
+	log.SetOutput(out)
+
+	return nil
+}
+
+// newRunID returns a random id that ties together the log lines of a run
+func newRunID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// contextHook adds fields to every entry that doesn't set them itself
+type contextHook struct {
+	mu     sync.RWMutex
+	fields logrus.Fields
+}
+
+func (h *contextHook) set(name string, value interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.fields[name] = value
+}
+
+func (h *contextHook) get(name string) interface{} {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.fields[name]
+}
+
+func (h *contextHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *contextHook) Fire(entry *logrus.Entry) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for name, value := range h.fields {
+		if _, ok := entry.Data[name]; !ok {
+			entry.Data[name] = value
+		}
+	}
+	return nil
+}
+
+// journalHook sends entries to journald with their fields as journal fields
+type journalHook struct{}
+
+func (journalHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (journalHook) Fire(entry *logrus.Entry) error {
+	fields := map[string]string{"SYSLOG_IDENTIFIER": "netbox-agent"}
+	for name, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			fields[name] = v
+		case error:
+			fields[name] = v.Error()
+		case fmt.Stringer:
+			fields[name] = v.String()
+		default:
+			data, err := json.Marshal(v)
+			if err != nil {
+				data = []byte(fmt.Sprint(v))
+			}
+			fields[name] = string(data)
+		}
+	}
+
+	return systemd.JournalSend(journalPriority(entry.Level), entry.Message, fields)
+}
+
+func journalPriority(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel:
+		return systemd.PriErr
+	case logrus.WarnLevel:
+		return systemd.PriWarning
+	case logrus.InfoLevel:
+		return systemd.PriInfo
+	default:
+		return systemd.PriDebug
+	}
+}
+
+// sensitiveHeaders are replaced when requests are logged
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "X-Api-Key"}
+
+// redactHeaders returns a copy of the headers with credentials replaced
+func redactHeaders(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, name := range sensitiveHeaders {
+		if redacted.Get(name) != "" {
+			redacted.Set(name, config.Redacted)
+		}
+	}
+	return redacted
+}
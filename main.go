@@ -1,24 +1,17 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"github.com/iglov/netbox-agent/lib/config"
 	"github.com/iglov/netbox-agent/lib/dmidecode"
 	"github.com/iglov/netbox-agent/lib/ipmi"
+	"github.com/iglov/netbox-agent/lib/plugins"
 	"github.com/iglov/netbox-agent/lib/storage"
-	"github.com/joho/godotenv"
 	"github.com/sirupsen/logrus"
 	"os"
 	"strings"
-
-	"github.com/netbox-community/go-netbox/v4"
-)
-
-var (
-	version  = flag.Bool("v", false, "Print current version and exit.")
-	logLevel = flag.String("loglevel", "info", "Set log level: DEBUG, INFO, WARN, ERROR")
 )
 
 // Version contains main version of build. Get from compiler variables
@@ -27,6 +20,16 @@ var Version string
 // Initiate log
 var log = logrus.New()
 
+// Exit codes scripts can rely on
+const (
+	exitOK          = 0 // success, plan found nothing to change
+	exitFailure     = 1 // some objects failed to sync, or the run failed otherwise
+	exitUsage       = 2 // invalid command line or configuration
+	exitChanges     = 3 // plan found pending changes
+	exitCollection  = 4 // the inventory could not be collected
+	exitUnreachable = 5 // NetBox or the aggregator could not be reached
+)
+
 // FullSystemInfo is the common struct for all of our hardware components
 type FullSystemInfo struct {
 	Memory  []dmidecode.MemoryDeviceInfo `json:"memory"`
@@ -35,295 +38,415 @@ type FullSystemInfo struct {
 	Chassis []dmidecode.ChassisInfo      `json:"chassis"`
 	System  []dmidecode.SystemInfo       `json:"system"`
 	Storage []storage.DiskInfo           `json:"storage"`
+	BIOS    []dmidecode.BIOSInfo         `json:"bios"`
+	// Baseboard holds the boards of the host, the motherboard and e.g. daughter boards
+	Baseboard []dmidecode.BaseboardInfo `json:"baseboard"`
+	// Extra holds the results of collectors without a field of their own by collector name
+	Extra map[string]json.RawMessage `json:"extra,omitempty"`
+	// Plugins holds the results of the collector plugins by plugin name
+	Plugins map[string]plugins.Result `json:"plugins,omitempty"`
+	// CollectionErrors holds the status of every enabled collector, reports of older agents have none
+	CollectionErrors map[string]collectorStatus `json:"collection_errors,omitempty"`
 }
 
-func main() {
+var commands = map[string]func(args []string) int{
+	"collect": runCollect,
+	"plan":    runPlan,
+	"sync":    runSync,
+	"daemon":  runDaemon,
+	"serve":   runServe,
+	"server":  runServer,
+	"export":  runExport,
+	"import":  runImport,
+	"purge":   runPurge,
+	"version": runVersion,
+	"config":  runConfig,
+}
 
-	flag.Parse()
+const usage = `usage: netbox-agent <command> [flags]
 
-	if *version {
-		fmt.Println(Version)
-		os.Exit(0)
-	}
+commands:
+  collect   print the collected inventory as JSON
+  plan      show the changes sync would make in NetBox
+  sync      write the inventory to NetBox (default)
+  daemon    sync every daemon.interval until stopped
+  serve     serve the inventory on http.listen without syncing
+  server    receive reports of agents and sync them to NetBox
+  export    write the report signed with the key of this host
+  import    sync a signed report after checking its signature
+  purge     remove the objects owned by the agent from NetBox
+  version   print the version
+  config    validate the configuration
+
+Run "netbox-agent <command> -h" for the flags of a command.
+`
+
+func main() {
 
 	// Set log output to stdout
 	log.Out = os.Stdout
 
-	// Parse the log level and set it
-	level, err := logrus.ParseLevel(strings.ToLower(*logLevel))
-	if err != nil {
-		log.Fatalf("Invalid log level: %s", *logLevel)
+	// Without a command the agent syncs, as it always did
+	name, args := "sync", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
 	}
-	log.SetLevel(level)
 
-	// Fetch memory device information
-	memDevices, err := dmidecode.GetMemoryDevices()
-	if err != nil {
-		log.Fatalf("Error fetching memory devices: %s", err)
+	run, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", name, usage)
+		os.Exit(exitUsage)
 	}
 
-	// Fetch CPU information
-	cpuInfo, err := dmidecode.GetCPUInfo()
-	if err != nil {
-		log.Fatalf("Error fetching CPU information: %s", err)
+	os.Exit(run(args))
+}
+
+// setup parses the command line and loads the config.
+// It returns a non-zero exit code if the command should stop.
+func setup(fs *flag.FlagSet, args []string, needNetBox bool) (*config.Config, int) {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil, exitOK
+		}
+		return nil, exitUsage
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected arguments: %s\n", strings.Join(fs.Args(), " "))
+		return nil, exitUsage
 	}
 
-	// Fetch IPMI information
-	bmcInfo := ipmi.GetBmcInfo()
+	if fs.Lookup("v").Value.String() == "true" {
+		fmt.Println(Version)
+		return nil, exitOK
+	}
 
-	// Fetch chassis information
-	chassisInfo, err := dmidecode.GetChassisInfo()
+	// Merge defaults, config file, environment and flags
+	cfg, err := loadConfig(fs)
 	if err != nil {
-		log.Fatalf("Error fetching chassis information: %s", err)
+		log.Errorf("Error loading config: %s", err)
+		return nil, exitUsage
 	}
 
-	// Fetch system information
-	systemInfo, err := dmidecode.GetSystemInfo()
-	if err != nil {
-		log.Fatalf("Error fetching system information: %s", err)
+	if err := cfg.Validate(); err != nil {
+		log.Error(err)
+		return nil, exitUsage
+	}
+	if needNetBox {
+		if err := cfg.ValidateNetBox(); err != nil {
+			log.Error(err)
+			return nil, exitUsage
+		}
 	}
 
-	// Fetch storage information
-	storageInfo, err := storage.GetStorageInfo()
-	if err != nil {
-		log.Fatalf("Error fetching storage information: %s", err)
+	if err := setupLogging(cfg); err != nil {
+		log.Error(err)
+		return nil, exitUsage
 	}
+	logContext.set("run_id", newRunID())
 
-	// Combine all the data into SystemInfo struct
-	fullSystemInfo := FullSystemInfo{
-		Memory:  memDevices,
-		CPU:     cpuInfo,
-		Chassis: chassisInfo,
-		IPMI:    bmcInfo,
-		System:  systemInfo,
-		Storage: storageInfo,
+	return cfg, exitOK
+}
+
+// runVersion prints the version
+func runVersion(args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintln(os.Stderr, "usage: netbox-agent version")
+		return exitUsage
 	}
+	fmt.Println(Version)
+	return exitOK
+}
 
-	// Convert the SystemInfo struct to JSON
-	finalJSON, err := json.MarshalIndent(fullSystemInfo, "", "  ")
-	if err != nil {
-		log.Fatalf("Error marshalling final JSON: %s", err)
+// runCollect prints the collected inventory as JSON, it doesn't talk to NetBox
+func runCollect(args []string) int {
+	fs := newFlagSet("collect")
+	output := fs.String("output", "-", "Write the report to this file instead of stdout.")
+
+	// Keep stdout clean for the JSON document
+	log.Out = os.Stderr
+	logStdout = os.Stderr
+
+	cfg, code := setup(fs, args, false)
+	if cfg == nil {
+		return code
 	}
 
-	log.Debug(string(finalJSON))
+	sum := newRunSummary(cfg, "collect")
+
+	rep, err := inventoryReport(cfg, "", "")
+	if err != nil {
+		log.Error(err)
+		reportRun(cfg, "collect", nil, false)
+		sum.collectionFailed(err)
+		return sum.finish()
+	}
+	sum.collected(&rep.Inventory)
+	reportRun(cfg, "collect", &rep.Inventory, sum.ExitCode == exitOK)
 
-	//	if strings.Contains(*logLevel, "debug") {
-	//		os.Exit(0)
-	//	}
+	if err := writeJSONOutput(*output, rep); err != nil {
+		log.Errorf("Error writing report: %s", err)
+		sum.failed(err)
+	}
+	return sum.finish()
+}
 
-	err = godotenv.Load()
+// writeJSONOutput writes v as indented JSON to the file name, or to stdout if name is "-"
+func writeJSONOutput(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
-		log.Warn("Error loading .env , using local variables")
+		return err
 	}
+	data = append(data, '\n')
 
-	ctx := context.Background()
+	if name == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(name, data, 0o644)
+}
 
-	apiURL := os.Getenv("API_URL")
-	apiTOKEN := os.Getenv("API_TOKEN")
+// runPlan shows the changes sync would make without writing to NetBox
+func runPlan(args []string) int {
+	fs := newFlagSet("plan")
+	asJSON := fs.Bool("json", false, "Print the changes as JSON.")
+	from := fs.String("from", "", "Plan the report written by collect -output instead of collecting.")
+	hostname := fs.String("hostname", "", "Hostname of the unversioned -from report of an older agent.")
 
-	c := netbox.NewAPIClientFor(apiURL, apiTOKEN)
+	// Keep stdout clean for the changes
+	logStdout = os.Stderr
 
-	roleRequest := netbox.NewDeviceRoleRequestWithDefaults()
-	roleRequest.SetName("default device role")
-	roleRequest.SetSlug("default-device-role")
-	roleRequest.SetDescription("It's just a default role after server creation by API, it should be changed after server creation.")
-	roleRes, httpRes, err := c.DcimAPI.DcimDeviceRolesCreate(ctx).DeviceRoleRequest(*roleRequest).Execute()
+	cfg, code := setup(fs, args, true)
+	if cfg == nil {
+		return code
+	}
+	sum := newRunSummary(cfg, "plan")
 
+	rep, err := inventoryReport(cfg, *from, *hostname)
 	if err != nil {
-		log.Errorf("Error creating role: %s", err)
+		log.Error(err)
+		sum.collectionFailed(err)
+		return sum.finish()
 	}
+	sum.collected(&rep.Inventory)
 
-	log.Debugf("Response: %+v", roleRes)
-	log.Debugf("HTTP Response: %+v", httpRes)
-
-	hostname, err := os.Hostname()
+	targets, err := newTargets(cfg, true)
 	if err != nil {
-		log.Errorf("Error get hostname: %s", err)
+		log.Error(err)
+		sum.failed(err)
+		return sum.finish()
 	}
 
-	// Parse and set all variables
-	site := strings.Split(hostname, ".")[1]
-	productName := fullSystemInfo.System[0].ProductName
-	productVendor := fullSystemInfo.System[0].Manufacturer
-	productSerial := fullSystemInfo.System[0].SerialNumber
-	chassisVersion := fullSystemInfo.Chassis[0].Version
-	chassisSerial := fullSystemInfo.Chassis[0].SerialNumber
-	chassisVendor := fullSystemInfo.Chassis[0].Manufacturer
+	var sets []targetChanges
+	for _, t := range targets {
+		s := t.syncer()
+		s.syncReport(rep, nil, *from == "")
+		sets = append(sets, targetChanges{Target: t.name, Changes: s.changes})
+		sum.syncResult(t.name, s)
+	}
 
-	otherInfo := "Serial: " + productSerial + " | Chassis name: " + chassisVersion + " | Chassis serial: " + chassisSerial + " | Chassis vendor: " + chassisVendor
+	printChanges(sets, *asJSON)
 
-	productVendorLower := strings.ToLower(productVendor)
-	productNameLower := strings.ToLower(productName)
-	productNameHyphenated := strings.ReplaceAll(productNameLower, " ", "-")
-	productVendorName := productVendorLower + "-" + productNameHyphenated
+	if sum.ExitCode == exitOK && sum.changes() > 0 {
+		sum.ExitCode = exitChanges
+	}
+	return sum.finish()
+}
 
-	chassisVendorLower := strings.ToLower(chassisVendor)
-	chassisVersionLower := strings.ToLower(chassisVersion)
-	chassisVersionHyphenated := strings.ReplaceAll(chassisVersionLower, " ", "-")
-	chassisVendorName := chassisVendorLower + "-" + chassisVersionHyphenated
+// runSync writes the collected inventory to NetBox
+func runSync(args []string) int {
+	fs := newFlagSet("sync")
+	from := fs.String("from", "", "Sync the report written by collect -output instead of collecting.")
+	hostname := fs.String("hostname", "", "Hostname of the unversioned -from report of an older agent.")
+	rotateKey := fs.Bool("rotate-key", false, "Replace the public key stored on the device by the key of this host.")
 
-	// Start creating objects
-	siteRequest := netbox.NewWritableSiteRequestWithDefaults()
-	siteRequest.SetName(site)
-	siteRequest.SetSlug(site)
-	siteRequest.SetDescription("It's just a default Site after server creation by API, it should be changed after server creation.")
-	siteRes, httpRes, err := c.DcimAPI.DcimSitesCreate(ctx).WritableSiteRequest(*siteRequest).Execute()
+	cfg, code := setup(fs, args, false)
+	if cfg == nil {
+		return code
+	}
+	if err := validateTarget(cfg); err != nil {
+		log.Error(err)
+		return exitUsage
+	}
 
+	lock, err := acquireLock(cfg.LockFile)
 	if err != nil {
-		log.Errorf("Error creating site: %s", err)
+		log.Error(err)
+		return exitFailure
 	}
+	defer lock.release()
 
-	log.Debugf("Response: %+v", siteRes)
-	log.Debugf("HTTP Response: %+v", httpRes)
-
-	// Add blade chassis if exists
-	if chassisSerial != productSerial {
-		device := netbox.NewWritableDeviceWithConfigContextRequestWithDefaults()
-		device.SetSite(netbox.SiteRequest{Name: site, Slug: site})
-		device.SetRole(netbox.DeviceRoleRequest{Name: "default device role", Slug: "default-device-role"})
-		device.SetComments(otherInfo)
-		device.SetDeviceType(netbox.DeviceTypeRequest{Model: chassisVersion, Slug: chassisVendorName, Manufacturer: netbox.ManufacturerRequest{Name: chassisVendor, Slug: chassisVendorLower}})
-		device.SetName(chassisSerial)
-		device.SetSerial(chassisSerial)
+	sum := newRunSummary(cfg, "sync")
 
-		deviceRes, httpRes, err := c.DcimAPI.DcimDevicesCreate(ctx).WritableDeviceWithConfigContextRequest(*device).Execute()
+	rep, err := inventoryReport(cfg, *from, *hostname)
+	if err != nil {
+		log.Error(err)
+		reportRun(cfg, "sync", nil, false)
+		sum.collectionFailed(err)
+		return sum.finish()
+	}
+	sum.collected(&rep.Inventory)
 
+	// The aggregator writes to NetBox, the agent has no NetBox token
+	if cfg.Aggregator.URL != "" {
+		err := pushReport(cfg, rep)
+		reportRun(cfg, "sync", &rep.Inventory, err == nil)
 		if err != nil {
-			log.Errorf("Error creating device: %v", err)
+			log.Error(err)
+			sum.failed(err)
 		}
+		return sum.finish()
+	}
 
-		log.Debugf("Response: %+v", deviceRes)
-		log.Debugf("HTTP Response: %+v", httpRes)
+	targets, err := newTargets(cfg, false)
+	if err != nil {
+		log.Error(err)
+		reportRun(cfg, "sync", &rep.Inventory, false)
+		sum.failed(err)
+		return sum.finish()
+	}
 
+	// Clusters and guests are read from this host, they don't belong to a report of another run
+	var sets []targetChanges
+	for _, t := range targets {
+		s := t.syncer()
+		s.rotateKey = *rotateKey
+		s.syncReport(rep, nil, *from == "")
+		sets = append(sets, targetChanges{Target: t.name, Changes: s.changes})
+		sum.syncResult(t.name, s)
 	}
+	reportRun(cfg, "sync", &rep.Inventory, sum.ExitCode == exitOK)
+	notifyChanges(cfg, "sync", rep.Host.Hostname, sets)
 
-	device := netbox.NewWritableDeviceWithConfigContextRequestWithDefaults()
-	device.SetSite(netbox.SiteRequest{Name: site, Slug: site})
-	device.SetRole(netbox.DeviceRoleRequest{Name: "default device role", Slug: "default-device-role"})
-	device.SetComments(otherInfo)
-	device.SetDeviceType(netbox.DeviceTypeRequest{Model: productName, Slug: productVendorName, Manufacturer: netbox.ManufacturerRequest{Name: productVendor, Slug: productVendorLower}})
-	device.SetName(hostname)
-	device.SetSerial(productSerial)
-	device.SetLocalContextData(&fullSystemInfo)
+	return sum.finish()
+}
 
-	deviceRes, httpRes, err := c.DcimAPI.DcimDevicesCreate(ctx).WritableDeviceWithConfigContextRequest(*device).Execute()
+// inventoryReport reads the report given with -from, or collects the inventory of this host if from is empty.
+// hostname names the host of an unversioned report. A collected inventory passes the collect hooks.
+func inventoryReport(cfg *config.Config, from, hostname string) (*report, error) {
+	if from != "" {
+		return readReport(from, hostname)
+	}
+	if hostname != "" {
+		return nil, fmt.Errorf("-hostname is only for -from reports of older agents")
+	}
 
+	if err := preCollect(cfg); err != nil {
+		return nil, err
+	}
+	fullSystemInfo, err := collect(cfg)
 	if err != nil {
-		log.Errorf("Error creating device: %v", err)
+		return nil, err
 	}
+	rep, err := newReport(&fullSystemInfo)
+	if err != nil {
+		return nil, err
+	}
+	return postCollect(cfg, rep)
+}
 
-	log.Debugf("Response: %+v", deviceRes)
-	log.Debugf("HTTP Response: %+v", httpRes)
-
-	for i := range fullSystemInfo.CPU {
-		man := netbox.NewManufacturerRequestWithDefaults()
-		man.SetName(fullSystemInfo.CPU[i].Manufacturer)
-		man.SetSlug(strings.ToLower(fullSystemInfo.CPU[i].Manufacturer))
-		manRes, httpRes, err := c.DcimAPI.DcimManufacturersCreate(ctx).ManufacturerRequest(*man).Execute()
-		if err != nil {
-			log.Errorf("Error creating device: %v", err)
-		}
+// runPurge removes the objects owned by the agent, without -yes it only shows them
+func runPurge(args []string) int {
+	fs := newFlagSet("purge")
+	yes := fs.Bool("yes", false, "Delete the objects, otherwise only list them.")
+	asJSON := fs.Bool("json", false, "Print the changes as JSON.")
 
-		log.Debugf("Response: %+v", manRes)
-		log.Debugf("HTTP Response: %+v", httpRes)
+	// Keep stdout clean for the changes
+	logStdout = os.Stderr
 
-		inv := netbox.NewInventoryItemRequestWithDefaults()
-		inv.SetName("CPU")
-		inv.SetManufacturer(*man)
-		inv.SetPartId(fullSystemInfo.CPU[i].Version)
-		inv.SetCustomFields(map[string]interface{}{
-			"cpu_cores":   fullSystemInfo.CPU[i].CoreCount,
-			"cpu_threads": fullSystemInfo.CPU[i].ThreadCount,
-		})
-		inv.SetDevice(netbox.DeviceRequest{Name: *netbox.NewNullableString(&hostname)})
-		invRes, httpRes, err := c.DcimAPI.DcimInventoryItemsCreate(ctx).InventoryItemRequest(*inv).Execute()
+	cfg, code := setup(fs, args, true)
+	if cfg == nil {
+		return code
+	}
 
-		if err != nil {
-			log.Errorf("Error creating device: %v", err)
+	for _, t := range cfg.NetBoxTargets() {
+		if t.Sync.OwnerTag == "" {
+			log.Errorf("sync.owner_tag of target %s is empty, nothing is known to be owned by the agent", t.Name)
+			return exitUsage
 		}
+	}
 
-		log.Debugf("Response: %+v", invRes)
-		log.Debugf("HTTP Response: %+v", httpRes)
+	lock, err := acquireLock(cfg.LockFile)
+	if err != nil {
+		log.Error(err)
+		return exitFailure
 	}
+	defer lock.release()
 
-	for i := range fullSystemInfo.Memory {
-		man := netbox.NewManufacturerRequestWithDefaults()
-		man.SetName(fullSystemInfo.Memory[i].Manufacturer)
-		man.SetSlug(strings.ToLower(fullSystemInfo.Memory[i].Manufacturer))
-		manRes, httpRes, err := c.DcimAPI.DcimManufacturersCreate(ctx).ManufacturerRequest(*man).Execute()
-		if err != nil {
-			log.Errorf("Error creating device: %v", err)
-		}
+	sum := newRunSummary(cfg, "purge")
 
-		log.Debugf("Response: %+v", manRes)
-		log.Debugf("HTTP Response: %+v", httpRes)
-
-		inv := netbox.NewInventoryItemRequestWithDefaults()
-		inv.SetName("MEMORY")
-		inv.SetManufacturer(*man)
-		inv.SetPartId(fullSystemInfo.Memory[i].PartNumber)
-		inv.SetSerial(fullSystemInfo.Memory[i].SerialNumber)
-		inv.SetCustomFields(map[string]interface{}{
-			"memory_size":  fullSystemInfo.Memory[i].Size,
-			"memory_slot":  fullSystemInfo.Memory[i].DeviceLocator,
-			"memory_speed": fullSystemInfo.Memory[i].Speed,
-			"memory_type":  fullSystemInfo.Memory[i].Type,
-		})
-		inv.SetDevice(netbox.DeviceRequest{Name: *netbox.NewNullableString(&hostname)})
-		invRes, httpRes, err := c.DcimAPI.DcimInventoryItemsCreate(ctx).InventoryItemRequest(*inv).Execute()
+	// The device name may depend on the serial number
+	fullSystemInfo, err := collect(cfg)
+	if err != nil {
+		log.Error(err)
+		sum.collectionFailed(err)
+		return sum.finish()
+	}
+	sum.collected(&fullSystemInfo)
 
-		if err != nil {
-			log.Errorf("Error creating device: %v", err)
-		}
+	targets, err := newTargets(cfg, !*yes)
+	if err != nil {
+		log.Error(err)
+		sum.failed(err)
+		return sum.finish()
+	}
 
-		log.Debugf("Response: %+v", invRes)
-		log.Debugf("HTTP Response: %+v", httpRes)
+	var sets []targetChanges
+	for _, t := range targets {
+		s := t.syncer()
+		s.purge(&fullSystemInfo)
+		sets = append(sets, targetChanges{Target: t.name, Changes: s.changes})
+		sum.syncResult(t.name, s)
 	}
 
-	for i := range fullSystemInfo.Storage {
-		man := netbox.NewManufacturerRequestWithDefaults()
-		man.SetName(fullSystemInfo.Storage[i].Manufacturer)
-		//		man.SetName("Intel")
-		man.SetSlug(strings.ToLower(fullSystemInfo.Storage[i].Manufacturer))
-		manRes, httpRes, err := c.DcimAPI.DcimManufacturersCreate(ctx).ManufacturerRequest(*man).Execute()
-		if err != nil {
-			log.Errorf("Error creating device: %v", err)
-		}
+	printChanges(sets, *asJSON)
 
-		log.Debugf("Response: %+v", manRes)
-		log.Debugf("HTTP Response: %+v", httpRes)
-
-		inv := netbox.NewInventoryItemRequestWithDefaults()
-		inv.SetName("DISK")
-		inv.SetManufacturer(*man)
-		inv.SetPartId(fullSystemInfo.Storage[i].Model)
-		inv.SetSerial(fullSystemInfo.Storage[i].SerialNumber)
-		inv.SetCustomFields(map[string]interface{}{
-			"disk_size": fullSystemInfo.Storage[i].Size,
-			"disk_slot": fullSystemInfo.Storage[i].Slot,
-		})
-		inv.SetDevice(netbox.DeviceRequest{Name: *netbox.NewNullableString(&hostname)})
-		invRes, httpRes, err := c.DcimAPI.DcimInventoryItemsCreate(ctx).InventoryItemRequest(*inv).Execute()
+	return sum.finish()
+}
 
-		if err != nil {
-			log.Errorf("Error creating device: %v", err)
+// printChanges prints the change sets to stdout.
+// A single target prints its changes as before, several targets are printed one after another under their name.
+func printChanges(sets []targetChanges, asJSON bool) {
+	for i := range sets {
+		if sets[i].Changes == nil {
+			sets[i].Changes = []change{}
 		}
-
-		log.Debugf("Response: %+v", invRes)
-		log.Debugf("HTTP Response: %+v", httpRes)
 	}
 
-	netInt := netbox.NewWritableInterfaceRequestWithDefaults()
-	netInt.SetName("IMPI")
-	netInt.SetDevice(netbox.DeviceRequest{Name: *netbox.NewNullableString(&hostname)})
-	netInt.SetType("1000base-tx")
-	netIntRes, httpRes, err := c.DcimAPI.DcimInterfacesCreate(ctx).WritableInterfaceRequest(*netInt).Execute()
+	if asJSON {
+		var v interface{} = sets
+		if len(sets) == 1 {
+			v = sets[0].Changes
+		}
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			log.Errorf("Error marshalling changes: %s", err)
+			return
+		}
+		fmt.Println(string(data))
+		return
+	}
 
-	if err != nil {
-		log.Errorf("Error creating device: %v", err)
+	for _, set := range sets {
+		if len(sets) > 1 {
+			fmt.Printf("# %s\n", set.Target)
+		}
+		printChangeLines(set.Changes)
 	}
+}
 
-	log.Debugf("Response: %+v", netIntRes)
-	log.Debugf("HTTP Response: %+v", httpRes)
+func printChangeLines(changes []change) {
+	if len(changes) == 0 {
+		fmt.Println("No changes")
+		return
+	}
 
+	symbols := map[string]string{"create": "+", "update": "~", "delete": "-"}
+	for _, ch := range changes {
+		line := fmt.Sprintf("%s %s %s", symbols[ch.Action], ch.Object, ch.Name)
+		if len(ch.Fields) > 0 {
+			fields, _ := json.Marshal(ch.Fields)
+			line += " " + string(fields)
+		}
+		fmt.Println(line)
+	}
 }
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/iglov/netbox-agent/lib/dmidecode"
+	"github.com/iglov/netbox-agent/lib/ipmi"
+	"github.com/iglov/netbox-agent/lib/storage"
+)
+
+// syncMapper connects a collector to the inventory and to the NetBox objects of the device.
+// Results of collectors without a mapper are kept in the extra section of the inventory.
+type syncMapper struct {
+	collector string
+	// store puts the result of the collector into the inventory
+	store func(info *FullSystemInfo, result interface{})
+	// items maps the collected entries to inventory items named itemName
+	itemName string
+	items    func(info *FullSystemInfo) []inventoryItem
+	// customFields returns custom fields of the device
+	customFields func(s *syncer, info *FullSystemInfo) map[string]interface{}
+	// sync writes other objects of the device
+	sync func(s *syncer, deviceID int32, deviceName string, info *FullSystemInfo)
+}
+
+// syncMappers holds the mappers in the order their items and objects are synced
+var syncMappers []*syncMapper
+
+// registerSyncMapper adds the mapper of a collector
+func registerSyncMapper(m *syncMapper) {
+	syncMappers = append(syncMappers, m)
+}
+
+// syncMapperOf returns the mapper of a collector, nil if it has none
+func syncMapperOf(collector string) *syncMapper {
+	for _, m := range syncMappers {
+		if m.collector == collector {
+			return m
+		}
+	}
+	return nil
+}
+
+func init() {
+	registerSyncMapper(&syncMapper{
+		collector: "cpu",
+		store: func(info *FullSystemInfo, result interface{}) {
+			info.CPU, _ = dmidecode.CPUCollector.Result(result)
+		},
+		itemName: "CPU",
+		items:    cpuItems,
+	})
+	registerSyncMapper(&syncMapper{
+		collector: "memory",
+		store: func(info *FullSystemInfo, result interface{}) {
+			info.Memory, _ = dmidecode.MemoryCollector.Result(result)
+		},
+		itemName: "MEMORY",
+		items:    memoryItems,
+	})
+	registerSyncMapper(&syncMapper{
+		collector: "storage",
+		store: func(info *FullSystemInfo, result interface{}) {
+			info.Storage, _ = storage.DiskCollector.Result(result)
+		},
+		itemName: "DISK",
+		items:    diskItems,
+	})
+	registerSyncMapper(&syncMapper{
+		collector: "baseboard",
+		store: func(info *FullSystemInfo, result interface{}) {
+			info.Baseboard, _ = dmidecode.BaseboardCollector.Result(result)
+		},
+		itemName: "BASEBOARD",
+		items:    baseboardItems,
+	})
+	registerSyncMapper(&syncMapper{
+		collector: "ipmi",
+		store: func(info *FullSystemInfo, result interface{}) {
+			info.IPMI, _ = ipmi.BmcCollector.Result(result)
+		},
+		sync: syncBmcInterface,
+	})
+	// The device is made from the system and chassis information, see syncInventory
+	registerSyncMapper(&syncMapper{
+		collector: "system",
+		store: func(info *FullSystemInfo, result interface{}) {
+			info.System, _ = dmidecode.SystemCollector.Result(result)
+		},
+	})
+	registerSyncMapper(&syncMapper{
+		collector: "chassis",
+		store: func(info *FullSystemInfo, result interface{}) {
+			info.Chassis, _ = dmidecode.ChassisCollector.Result(result)
+		},
+	})
+	registerSyncMapper(&syncMapper{
+		collector: "bios",
+		store: func(info *FullSystemInfo, result interface{}) {
+			info.BIOS, _ = dmidecode.BIOSCollector.Result(result)
+		},
+		customFields: biosCustomFields,
+	})
+}
+
+// cpuItems maps the CPU sockets to inventory items
+func cpuItems(fullSystemInfo *FullSystemInfo) []inventoryItem {
+	var items []inventoryItem
+	for _, cpu := range fullSystemInfo.CPU {
+		items = append(items, inventoryItem{
+			Name:         "CPU",
+			Label:        cpu.SocketDesignation,
+			Manufacturer: cpu.Manufacturer,
+			PartID:       cpu.Version,
+			CustomFields: map[string]interface{}{
+				"cpu_cores":   cpu.CoreCount,
+				"cpu_threads": cpu.ThreadCount,
+			},
+		})
+	}
+	return items
+}
+
+// memoryItems maps the memory modules to inventory items
+func memoryItems(fullSystemInfo *FullSystemInfo) []inventoryItem {
+	var items []inventoryItem
+	for _, mem := range fullSystemInfo.Memory {
+		items = append(items, inventoryItem{
+			Name:         "MEMORY",
+			Label:        mem.DeviceLocator,
+			Manufacturer: mem.Manufacturer,
+			PartID:       mem.PartNumber,
+			Serial:       mem.SerialNumber,
+			CustomFields: map[string]interface{}{
+				"memory_size":  mem.Size,
+				"memory_slot":  mem.DeviceLocator,
+				"memory_speed": mem.Speed,
+				"memory_type":  mem.Type,
+			},
+		})
+	}
+	return items
+}
+
+// diskItems maps the disks to inventory items, labelled by slot or by name
+func diskItems(fullSystemInfo *FullSystemInfo) []inventoryItem {
+	var items []inventoryItem
+	for _, disk := range fullSystemInfo.Storage {
+		label := disk.Slot
+		if label == "" {
+			label = disk.Name
+		}
+		items = append(items, inventoryItem{
+			Name:         "DISK",
+			Label:        label,
+			Manufacturer: disk.Manufacturer,
+			PartID:       disk.Model,
+			Serial:       disk.SerialNumber,
+			CustomFields: map[string]interface{}{
+				"disk_size": disk.Size,
+				"disk_slot": disk.Slot,
+			},
+		})
+	}
+	return items
+}
+
+// Custom fields of the device holding the BIOS details
+const (
+	biosVersionField = "bios_version"
+	biosDateField    = "bios_date"
+)
+
+// biosCustomFields returns the BIOS version and release date of the device, nothing if the BIOS is unknown
+func biosCustomFields(s *syncer, fullSystemInfo *FullSystemInfo) map[string]interface{} {
+	if !s.cfg.Sync.BIOSCustomFields || len(fullSystemInfo.BIOS) == 0 {
+		return nil
+	}
+
+	bios := fullSystemInfo.BIOS[0]
+	fields := map[string]interface{}{biosVersionField: bios.Version}
+	if date, ok := biosDate(bios.ReleaseDate); ok {
+		fields[biosDateField] = date
+	} else {
+		s.log.Debugf("Not setting %s, unknown release date %q", biosDateField, bios.ReleaseDate)
+	}
+	return fields
+}
+
+// biosDate converts the SMBIOS release date, MM/DD/YYYY or MM/DD/YY before SMBIOS 2.3, to YYYY-MM-DD
+func biosDate(date string) (string, bool) {
+	for _, layout := range []string{"01/02/2006", "01/02/06"} {
+		if t, err := time.Parse(layout, date); err == nil {
+			return t.Format(time.DateOnly), true
+		}
+	}
+	return "", false
+}
+
+// baseboardItems maps the boards to inventory items labelled by board type, so a replaced board shows as a new serial.
+// Boards of the same type are numbered in table order.
+func baseboardItems(fullSystemInfo *FullSystemInfo) []inventoryItem {
+	var items []inventoryItem
+	seen := map[string]int{}
+	for _, board := range fullSystemInfo.Baseboard {
+		label := board.BoardType
+		if seen[board.BoardType] > 0 {
+			label = fmt.Sprintf("%s %d", board.BoardType, seen[board.BoardType])
+		}
+		seen[board.BoardType]++
+
+		items = append(items, inventoryItem{
+			Name:         "BASEBOARD",
+			Label:        label,
+			Manufacturer: board.Manufacturer,
+			PartID:       board.ProductName,
+			Serial:       board.SerialNumber,
+		})
+	}
+	return items
+}
+
+// syncBmcInterface adds the BMC interface, a host without an IPMI device has no BMC
+func syncBmcInterface(s *syncer, deviceID int32, deviceName string, fullSystemInfo *FullSystemInfo) {
+	if s.cfg.Sync.BmcInterface && !fullSystemInfo.collectorSkipped("ipmi") {
+		s.syncInterface(deviceID, deviceName, "IMPI", "1000base-tx")
+	}
+}
+
+// pluginItems maps the items declared by the collector plugins to inventory items, in the order of the plugin names
+func pluginItems(fullSystemInfo *FullSystemInfo) []inventoryItem {
+	var items []inventoryItem
+	for _, name := range pluginNames(fullSystemInfo) {
+		for _, item := range fullSystemInfo.Plugins[name].Items {
+			items = append(items, inventoryItem{
+				Name:         item.Name,
+				Label:        item.Label,
+				Manufacturer: item.Manufacturer,
+				PartID:       item.PartID,
+				Serial:       item.Serial,
+				CustomFields: item.CustomFields,
+			})
+		}
+	}
+	return items
+}
+
+// pluginCustomFields returns the device custom fields of the collector plugins, a later plugin name wins a clash
+func pluginCustomFields(fullSystemInfo *FullSystemInfo) map[string]interface{} {
+	var fields map[string]interface{}
+	for _, name := range pluginNames(fullSystemInfo) {
+		fields = mergeFields(fields, fullSystemInfo.Plugins[name].CustomFields)
+	}
+	return fields
+}
+
+// pluginNames returns the names of the plugins with a result, sorted
+func pluginNames(fullSystemInfo *FullSystemInfo) []string {
+	var names []string
+	for name := range fullSystemInfo.Plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// pluginFailed reports whether a collector plugin ran and failed.
+// Any failed collector without a sync mapper counts, as the names of the plugins are only known at run time.
+func (f *FullSystemInfo) pluginFailed() bool {
+	for name, status := range f.CollectionErrors {
+		if syncMapperOf(name) == nil && status.failed() {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeFields returns the fields of a with those of b on top, nil if both are empty
+func mergeFields(a, b map[string]interface{}) map[string]interface{} {
+	if len(b) == 0 {
+		return a
+	}
+	merged := make(map[string]interface{}, len(a)+len(b))
+	for k, v := range a {
+		merged[k] = v
+	}
+	for k, v := range b {
+		merged[k] = v
+	}
+	return merged
+}
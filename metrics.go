@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iglov/netbox-agent/lib/config"
+	"github.com/iglov/netbox-agent/lib/dmidecode"
+	"github.com/iglov/netbox-agent/lib/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// agentMetrics holds the metrics of the agent and the hardware facts of the last collection
+var agentMetrics = newAgentMetrics()
+
+func newAgentMetrics() *metrics.Registry {
+	r := metrics.NewRegistry()
+
+	r.Describe("netbox_agent_last_sync_timestamp_seconds", metrics.Gauge, "Time of the last finished sync by target.")
+	r.Describe("netbox_agent_last_sync_success", metrics.Gauge, "Whether the last sync to the target finished without failures.")
+	r.Describe("netbox_agent_syncs_total", metrics.Counter, "Finished syncs by target and result.")
+	r.Describe("netbox_agent_objects_changed_total", metrics.Counter, "NetBox objects written by target, action and object type.")
+	r.Describe("netbox_agent_api_requests_total", metrics.Counter, "NetBox API requests by target, endpoint, method and status code.")
+	r.Describe("netbox_agent_collector_duration_seconds", metrics.Gauge, "Duration of the last run of a collector.")
+	r.Describe("netbox_agent_collector_errors_total", metrics.Counter, "Failed runs of a collector.")
+	r.Describe("netbox_agent_collection_duration_seconds", metrics.Gauge, "Wall time of the last collection, the collectors run in parallel.")
+
+	r.Describe("netbox_agent_memory_modules", metrics.Gauge, "Installed memory modules.")
+	r.Describe("netbox_agent_memory_bytes", metrics.Gauge, "Total size of the installed memory modules.")
+	r.Describe("netbox_agent_disks", metrics.Gauge, "Detected disks.")
+	r.Describe("netbox_agent_cpu_cores", metrics.Gauge, "CPU cores of all sockets.")
+	r.Describe("netbox_agent_bmc_up", metrics.Gauge, "Whether the BMC answered over IPMI.")
+
+	return r
+}
+
+// observeCollector records the duration and failure of a collector run
+func observeCollector(name string, start time.Time, err error) {
+	labels := metrics.Labels{"collector": name}
+	agentMetrics.Set("netbox_agent_collector_duration_seconds", labels, time.Since(start).Seconds())
+	if err != nil {
+		agentMetrics.Add("netbox_agent_collector_errors_total", labels, 1)
+	}
+}
+
+// observeHardware sets the hardware gauges from the collected inventory
+func observeHardware(cfg config.CollectorsConfig, fullSystemInfo *FullSystemInfo) {
+	if cfg.Memory {
+		var size float64
+		for _, mem := range fullSystemInfo.Memory {
+			size += memoryBytes(mem)
+		}
+		agentMetrics.Set("netbox_agent_memory_modules", nil, float64(len(fullSystemInfo.Memory)))
+		agentMetrics.Set("netbox_agent_memory_bytes", nil, size)
+	}
+
+	if cfg.Storage {
+		agentMetrics.Set("netbox_agent_disks", nil, float64(len(fullSystemInfo.Storage)))
+	}
+
+	if cfg.CPU {
+		var cores float64
+		for _, cpu := range fullSystemInfo.CPU {
+			cores += float64(cpu.CoreCount)
+		}
+		agentMetrics.Set("netbox_agent_cpu_cores", nil, cores)
+	}
+
+	if cfg.IPMI {
+		up := 0.0
+		if fullSystemInfo.IPMI.FwRev != "" || fullSystemInfo.IPMI.Ipaddr != "" {
+			up = 1
+		}
+		agentMetrics.Set("netbox_agent_bmc_up", nil, up)
+	}
+}
+
+// memoryBytes returns the size of a memory module in bytes
+func memoryBytes(mem dmidecode.MemoryDeviceInfo) float64 {
+	return float64(mem.SizeMB) * (1 << 20)
+}
+
+// observeSync records the result of a sync to a target and the objects it wrote
+func observeSync(target string, s *syncer) {
+	observeSyncResult(target, s.failures == 0)
+
+	if s.dryRun {
+		return
+	}
+	for _, ch := range s.changes {
+		agentMetrics.Add("netbox_agent_objects_changed_total", metrics.Labels{"target": target, "action": ch.Action, "object": ch.Object}, 1)
+	}
+}
+
+// observeSyncResult records a finished sync, or a report sent to the aggregator (target "aggregator")
+func observeSyncResult(target string, success bool) {
+	success01, result := 1.0, "success"
+	if !success {
+		success01, result = 0, "failure"
+	}
+
+	agentMetrics.Set("netbox_agent_last_sync_timestamp_seconds", metrics.Labels{"target": target}, float64(time.Now().Unix()))
+	agentMetrics.Set("netbox_agent_last_sync_success", metrics.Labels{"target": target}, success01)
+	agentMetrics.Add("netbox_agent_syncs_total", metrics.Labels{"target": target, "result": result}, 1)
+}
+
+// apiTransport counts and logs the NetBox API requests of a target
+type apiTransport struct {
+	target string
+	next   http.RoundTripper
+}
+
+func (t apiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(res.StatusCode)
+	}
+
+	fields := logrus.Fields{
+		"target":      t.target,
+		"method":      req.Method,
+		"path":        req.URL.Path,
+		"status":      code,
+		"duration_ms": time.Since(start).Milliseconds(),
+	}
+	if log.IsLevelEnabled(logrus.TraceLevel) {
+		fields["headers"] = redactHeaders(req.Header)
+	}
+	if err != nil {
+		log.WithFields(fields).WithError(err).Debug("NetBox API call failed")
+	} else {
+		log.WithFields(fields).Debug("NetBox API call")
+	}
+	agentMetrics.Add("netbox_agent_api_requests_total", metrics.Labels{
+		"target":   t.target,
+		"endpoint": apiEndpoint(req.URL.Path),
+		"method":   req.Method,
+		"code":     code,
+	}, 1)
+
+	return res, err
+}
+
+// apiEndpoint reduces a request path such as /api/dcim/devices/12/ to dcim/devices
+func apiEndpoint(path string) string {
+	var parts []string
+	for _, part := range strings.Split(path, "/") {
+		if part == "" || part == "api" {
+			continue
+		}
+		if _, err := strconv.Atoi(part); err == nil {
+			continue
+		}
+		parts = append(parts, part)
+		if len(parts) == 2 {
+			break
+		}
+	}
+	return strings.Join(parts, "/")
+}
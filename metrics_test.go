@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/iglov/netbox-agent/lib/config"
+	"github.com/iglov/netbox-agent/lib/dmidecode"
+	"github.com/iglov/netbox-agent/lib/metrics"
+)
+
+func TestObserveHardwareMemoryBytes(t *testing.T) {
+	defer func(r *metrics.Registry) { agentMetrics = r }(agentMetrics)
+	agentMetrics = newAgentMetrics()
+	info := &FullSystemInfo{Memory: []dmidecode.MemoryDeviceInfo{
+		{Size: 16, SizeMB: 16384, DeviceLocator: "DIMM_A1"},
+		{Size: 0, SizeMB: 512, DeviceLocator: "DIMM_B1"},
+	}}
+	observeHardware(config.CollectorsConfig{Memory: true}, info)
+
+	var buf bytes.Buffer
+	if err := agentMetrics.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"netbox_agent_memory_modules 2\n",
+		"netbox_agent_memory_bytes 1.7716740096e+10\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing %q in:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestTextfileMemoryModuleSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netbox_agent.prom")
+	info := &FullSystemInfo{Memory: []dmidecode.MemoryDeviceInfo{{Size: 0, SizeMB: 512, DeviceLocator: "DIMM_A1"}}}
+	if err := writeTextfile(path, "sync", info, true); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `netbox_agent_memory_module_size_bytes{slot="DIMM_A1"} 5.36870912e+08` + "\n"; !strings.Contains(string(data), want) {
+		t.Errorf("missing %q in:\n%s", want, data)
+	}
+}
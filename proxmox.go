@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/iglov/netbox-agent/lib/proxmox"
+	"github.com/netbox-community/go-netbox/v4"
+)
+
+func init() {
+	proxmox.Warnf = log.Warnf
+}
+
+// syncProxmox adds this node to its Proxmox VE cluster and upserts the guests running on it.
+// The guests need their host in the cluster, they are skipped unless member is set.
+func (s *syncer) syncProxmox(hostname, site string, member bool) {
+	if !proxmox.IsPresent() {
+		log.Debug("Proxmox VE not found, skipping cluster discovery")
+		return
+	}
+	if !member {
+		log.Warnf("Device %s is a member of a cluster before proxmox in collectors.cluster_precedence, skipping Proxmox VE guests", hostname)
+		return
+	}
+
+	node, err := proxmox.LocalNode()
+	if err != nil {
+		s.failCollector("proxmox", "Error detecting Proxmox VE node name", err)
+		return
+	}
+
+	clusterInfo, err := proxmox.GetClusterInfo()
+	if err != nil {
+		s.failCollector("proxmox", "Error reading corosync config", err)
+		return
+	}
+
+	// A standalone node is a cluster of its own
+	clusterName := node
+	if clusterInfo != nil {
+		clusterName = clusterInfo.Name
+	}
+
+	guestInfo, err := proxmox.GetGuests()
+	if err != nil {
+		s.failCollector("proxmox", "Error fetching Proxmox VE guests", err)
+		return
+	}
+
+	cluster := s.ensureCluster(clusterName, "proxmox", site)
+	if cluster == nil {
+		return
+	}
+	s.assignDeviceToCluster(hostname, cluster)
+
+	var guests []guest
+	elsewhere := map[string]bool{}
+	for _, g := range guestInfo {
+		if g.Node != node {
+			// Migrated guests are synced by the node that runs them now
+			elsewhere[g.Name] = true
+			continue
+		}
+		guests = append(guests, proxmoxGuest(g))
+	}
+
+	retiredStatus := netbox.PatchedWritableModuleRequestStatus(s.cfg.Collectors.Proxmox.UndefinedStatus)
+	s.syncGuests(cluster, hostname, guests, elsewhere, retiredStatus)
+}
+
+func proxmoxGuest(info proxmox.GuestInfo) guest {
+	g := guest{
+		Name:     info.Name,
+		VCPUs:    float64(info.Cores),
+		MemoryMB: info.MemoryMB,
+		Status:   netbox.PATCHEDWRITABLEMODULEREQUESTSTATUS_OFFLINE,
+		Context:  info,
+	}
+	if info.Running {
+		g.Status = netbox.PATCHEDWRITABLEMODULEREQUESTSTATUS_ACTIVE
+	}
+	if info.Template {
+		g.Status = netbox.PATCHEDWRITABLEMODULEREQUESTSTATUS_STAGED
+	}
+
+	for _, disk := range info.Disks {
+		g.Disks = append(g.Disks, guestDisk{
+			Name:        disk.Name,
+			SizeGB:      disk.SizeGB,
+			Description: disk.Volume,
+		})
+	}
+
+	for _, iface := range info.Interfaces {
+		description := ""
+		if iface.Bridge != "" {
+			description = fmt.Sprintf("Bridge: %s", iface.Bridge)
+			if iface.VlanTag != "" {
+				description += fmt.Sprintf(" | VLAN: %s", iface.VlanTag)
+			}
+		}
+		g.Interfaces = append(g.Interfaces, guestInterface{
+			Name:        iface.Name,
+			MacAddress:  iface.MacAddress,
+			Description: description,
+		})
+	}
+
+	return g
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// purge deletes the objects of this host owned by the agent: virtual machines hosted on the device,
+// inventory items, interfaces and the device itself. Objects without the owner tag are left alone.
+func (s *syncer) purge(fullSystemInfo *FullSystemInfo) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		s.fail("dcim.device", "Error get hostname", err)
+		return
+	}
+
+	host, err := resolveHost(s.cfg, hostname, fullSystemInfo)
+	if err != nil {
+		s.fail("dcim.device", "Error resolving device", err)
+		return
+	}
+
+	owner := []string{slugify(s.cfg.Sync.OwnerTag)}
+
+	deviceRes, _, err := s.c.DcimAPI.DcimDevicesList(s.ctx).Name([]string{host.DeviceName}).Execute()
+	if err != nil {
+		s.fail("dcim.device", "Error listing devices", err)
+		return
+	}
+	debugResponse(deviceRes)
+
+	if len(deviceRes.Results) == 0 {
+		log.Infof("Device %s not found, nothing to purge", host.DeviceName)
+		return
+	}
+	dev := deviceRes.Results[0]
+
+	vmRes, _, err := s.c.VirtualizationAPI.VirtualizationVirtualMachinesList(s.ctx).DeviceId([]*int32{&dev.Id}).Tag(owner).Limit(1000).Execute()
+	if err != nil {
+		s.fail("virtualization.virtualmachine", "Error listing virtual machines", err)
+		return
+	}
+	debugResponse(vmRes)
+
+	for _, vm := range vmRes.Results {
+		if !s.record("delete", "virtualization.virtualmachine", vm.Name, nil) {
+			continue
+		}
+		_, err := s.c.VirtualizationAPI.VirtualizationVirtualMachinesDestroy(s.ctx, vm.Id).Execute()
+		if err != nil {
+			s.fail("virtualization.virtualmachine", "Error deleting virtual machine", err)
+			continue
+		}
+	}
+
+	invRes, _, err := s.c.DcimAPI.DcimInventoryItemsList(s.ctx).DeviceId([]int32{dev.Id}).Tag(owner).Limit(1000).Execute()
+	if err != nil {
+		s.fail("dcim.inventoryitem", "Error listing inventory items", err)
+		return
+	}
+	debugResponse(invRes)
+
+	for _, inv := range invRes.Results {
+		if !s.record("delete", "dcim.inventoryitem", inv.Name+"/"+inv.GetLabel(), nil) {
+			continue
+		}
+		_, err := s.c.DcimAPI.DcimInventoryItemsDestroy(s.ctx, inv.Id).Execute()
+		if err != nil {
+			s.fail("dcim.inventoryitem", "Error deleting inventory item", err)
+			continue
+		}
+	}
+
+	ifRes, _, err := s.c.DcimAPI.DcimInterfacesList(s.ctx).DeviceId([]int32{dev.Id}).Tag(owner).Limit(1000).Execute()
+	if err != nil {
+		s.fail("dcim.interface", "Error listing interfaces", err)
+		return
+	}
+	debugResponse(ifRes)
+
+	for _, iface := range ifRes.Results {
+		if !s.record("delete", "dcim.interface", host.DeviceName+"/"+iface.Name, nil) {
+			continue
+		}
+		_, err := s.c.DcimAPI.DcimInterfacesDestroy(s.ctx, iface.Id).Execute()
+		if err != nil {
+			s.fail("dcim.interface", "Error deleting interface", err)
+			continue
+		}
+	}
+
+	// Devices created before the owner tag existed are kept, they may carry manual changes
+	if !hasTag(dev.Tags, s.cfg.Sync.OwnerTag) {
+		log.Infof("Device %s is not tagged %s, keeping it", host.DeviceName, s.cfg.Sync.OwnerTag)
+		return
+	}
+	if !s.record("delete", "dcim.device", host.DeviceName, nil) {
+		return
+	}
+	_, err = s.c.DcimAPI.DcimDevicesDestroy(s.ctx, dev.Id).Execute()
+	if err != nil {
+		s.fail("dcim.device", "Error deleting device", fmt.Errorf("%s: %w", host.DeviceName, err))
+		return
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/iglov/netbox-agent/lib/config"
+	"github.com/iglov/netbox-agent/lib/signing"
+)
+
+// reportVersion is the version of the report format, it changes when fields are removed or change their meaning.
+// Added fields keep the version, readers ignore the fields they don't know.
+const reportVersion = 1
+
+// legacyReportVersion is the version of the bare inventory written by agents before the report format
+const legacyReportVersion = 0
+
+// report is the inventory of a host as written by collect and sent to the aggregator
+type report struct {
+	Version   int            `json:"version"`
+	Host      reportHost     `json:"host"`
+	Inventory FullSystemInfo `json:"inventory"`
+}
+
+// reportHost describes the host and the run that collected the inventory
+type reportHost struct {
+	Hostname     string    `json:"hostname"`
+	CollectedAt  time.Time `json:"collected_at"`
+	AgentVersion string    `json:"agent_version"`
+	OS           string    `json:"os,omitempty"`
+	Kernel       string    `json:"kernel,omitempty"`
+	Arch         string    `json:"arch"`
+	MachineID    string    `json:"machine_id,omitempty"`
+}
+
+// Files the host metadata is read from
+var (
+	osReleaseFile = "/etc/os-release"
+	kernelFile    = "/proc/sys/kernel/osrelease"
+	machineIDFile = "/etc/machine-id"
+)
+
+// newReport wraps the inventory collected on this host
+func newReport(fullSystemInfo *FullSystemInfo) (*report, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("error get hostname: %s", err)
+	}
+
+	return &report{
+		Version: reportVersion,
+		Host: reportHost{
+			Hostname:     hostname,
+			CollectedAt:  time.Now().UTC(),
+			AgentVersion: Version,
+			OS:           osName(),
+			Kernel:       readTrimmed(kernelFile),
+			Arch:         runtime.GOARCH,
+			MachineID:    readTrimmed(machineIDFile),
+		},
+		Inventory: *fullSystemInfo,
+	}, nil
+}
+
+// readReport reads a report written by collect.
+// A bare inventory of an older agent has no host metadata, it is synced as a report of hostname.
+func readReport(name, hostname string) (*report, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("error reading report: %v", err)
+	}
+	if isSignedReport(data) {
+		return nil, fmt.Errorf("%s is a signed report, use netbox-agent import", name)
+	}
+
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", name, err)
+	}
+	if _, ok := probe["inventory"]; !ok {
+		return readLegacyReport(data, name, hostname)
+	}
+	var rep report
+	if err := json.Unmarshal(data, &rep); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", name, err)
+	}
+	if hostname != "" {
+		return nil, fmt.Errorf("%s is a versioned report of %q, -hostname is only for reports of older agents", name, rep.Host.Hostname)
+	}
+	if err := rep.validate(); err != nil {
+		return nil, fmt.Errorf("invalid report %s: %v", name, err)
+	}
+
+	return &rep, nil
+}
+
+// readLegacyReport wraps the bare inventory data of an older agent as a report of hostname
+func readLegacyReport(data []byte, name, hostname string) (*report, error) {
+	if hostname == "" {
+		return nil, fmt.Errorf("%s is an unversioned report of an older agent, give the hostname of its host with -hostname", name)
+	}
+
+	rep := report{Version: legacyReportVersion, Host: reportHost{Hostname: hostname}}
+	if err := json.Unmarshal(data, &rep.Inventory); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", name, err)
+	}
+	if err := rep.validateContent(); err != nil {
+		return nil, fmt.Errorf("invalid report %s: %v", name, err)
+	}
+
+	log.Infof("%s is an unversioned report of an older agent, syncing it as %s", name, hostname)
+	return &rep, nil
+}
+
+// validate checks that the report can be synced
+func (r *report) validate() error {
+	if r.Version == legacyReportVersion {
+		return fmt.Errorf("version is missing")
+	}
+	if r.Version > reportVersion {
+		return fmt.Errorf("version %d is newer than the supported version %d, upgrade the agent", r.Version, reportVersion)
+	}
+	return r.validateContent()
+}
+
+// validateContent checks the host and inventory of the report
+func (r *report) validateContent() error {
+	if r.Host.Hostname == "" {
+		return fmt.Errorf("hostname is missing")
+	}
+	if len(r.Inventory.System) == 0 {
+		return fmt.Errorf("system information is missing")
+	}
+	return nil
+}
+
+// osName returns PRETTY_NAME of os-release
+func osName() string {
+	data, err := os.ReadFile(osReleaseFile)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "PRETTY_NAME="); ok {
+			return strings.Trim(value, `"'`)
+		}
+	}
+	return ""
+}
+
+func readTrimmed(name string) string {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// validateTarget checks the settings of where sync writes to, the aggregator if one is set or NetBox
+func validateTarget(cfg *config.Config) error {
+	if cfg.Aggregator.URL == "" {
+		return cfg.ValidateNetBox()
+	}
+	if cfg.Aggregator.Token == "" && cfg.Aggregator.TLSCert == "" {
+		return fmt.Errorf("invalid config: aggregator needs a token or a tls_cert")
+	}
+	if (cfg.Aggregator.TLSCert == "") != (cfg.Aggregator.TLSKey == "") {
+		return fmt.Errorf("invalid config: aggregator.tls_cert and aggregator.tls_key go together")
+	}
+	return nil
+}
+
+// pushReport sends the report to the aggregator
+func pushReport(cfg *config.Config, rep *report) error {
+	data, err := json.Marshal(rep)
+	if err != nil {
+		return fmt.Errorf("error marshalling report: %s", err)
+	}
+	// Once export created a key the device only takes signed reports
+	if _, err := os.Stat(cfg.Signing.Key); err == nil {
+		key, err := signing.LoadOrCreateKey(cfg.Signing.Key)
+		if err != nil {
+			return err
+		}
+		if data, err = json.Marshal(signing.Sign(data, key)); err != nil {
+			return fmt.Errorf("error marshalling report: %s", err)
+		}
+	}
+
+	client, err := aggregatorClient(cfg.Aggregator)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(cfg.Aggregator.URL, "/")+"/api/v1/reports", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.Aggregator.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.Aggregator.Token)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending report: %w", err)
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.StatusCode != http.StatusAccepted {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("error sending report: %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+
+	log.Infof("Report sent to %s", cfg.Aggregator.URL)
+	return nil
+}
+
+// aggregatorClient returns an HTTP client trusting ca_file and presenting the client certificate if set
+func aggregatorClient(cfg config.AggregatorConfig) (*http.Client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if cfg.CAFile != "" {
+		ca, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", cfg.CAFile, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates in %s", cfg.CAFile)
+		}
+	}
+
+	if cfg.TLSCert != "" {
+		pair, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+
+	return &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+	}, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadReport(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		hostname string
+		wantHost string
+		wantErr  string
+	}{
+		{
+			name:     "versioned",
+			data:     `{"version":1,"host":{"hostname":"node1","arch":"amd64"},"inventory":{"system":[{"serial_number":"S1"}]}}`,
+			wantHost: "node1",
+		},
+		{
+			name:     "fields of a newer agent",
+			data:     `{"version":1,"host":{"hostname":"node1","arch":"amd64","rack":"r1"},"inventory":{"system":[{"serial_number":"S1"}],"gpu":[]}}`,
+			wantHost: "node1",
+		},
+		{
+			name:    "newer version",
+			data:    `{"version":2,"host":{"hostname":"node1"},"inventory":{"system":[{}]}}`,
+			wantErr: "newer than the supported version",
+		},
+		{
+			name:    "version missing",
+			data:    `{"host":{"hostname":"node1"},"inventory":{"system":[{}]}}`,
+			wantErr: "version is missing",
+		},
+		{
+			name:     "hostname for a versioned report",
+			data:     `{"version":1,"host":{"hostname":"node1"},"inventory":{"system":[{}]}}`,
+			hostname: "node2",
+			wantErr:  "-hostname is only for reports of older agents",
+		},
+		{
+			name:     "unversioned",
+			data:     `{"memory":[],"cpu":[],"ipmi":{},"chassis":[],"system":[{"serial_number":"S1"}],"storage":[]}`,
+			hostname: "node1",
+			wantHost: "node1",
+		},
+		{
+			name:    "unversioned without hostname",
+			data:    `{"system":[{"serial_number":"S1"}]}`,
+			wantErr: "give the hostname of its host with -hostname",
+		},
+		{
+			name:     "unversioned without system",
+			data:     `{"memory":[]}`,
+			hostname: "node1",
+			wantErr:  "system information is missing",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "report.json")
+			if err := os.WriteFile(name, []byte(tt.data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			rep, err := readReport(name, tt.hostname)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rep.Host.Hostname != tt.wantHost {
+				t.Errorf("hostname = %q, want %q", rep.Host.Hostname, tt.wantHost)
+			}
+			if rep.Inventory.System[0].SerialNumber != "S1" {
+				t.Errorf("serial = %q, want S1", rep.Inventory.System[0].SerialNumber)
+			}
+		})
+	}
+}
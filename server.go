@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/iglov/netbox-agent/lib/config"
+	"github.com/iglov/netbox-agent/lib/signing"
+)
+
+// maxReportSize limits the body of a report, a large host is well below 1 MB
+const maxReportSize = 8 << 20
+
+// hostStatus is the sync state of a host reporting to the aggregator
+type hostStatus struct {
+	Hostname     string           `json:"hostname"`
+	Remote       string           `json:"remote_addr"`
+	AgentVersion string           `json:"agent_version"`
+	CollectedAt  time.Time        `json:"collected_at"`
+	LastReport   time.Time        `json:"last_report"`
+	LastSync     time.Time        `json:"last_sync,omitempty"`
+	Result       string           `json:"result,omitempty"`
+	Changes      int              `json:"changes"`
+	Failures     int              `json:"failures"`
+	Targets      []*targetSummary `json:"targets,omitempty"`
+	Error        string           `json:"error,omitempty"`
+	Queued       bool             `json:"queued"`
+	Syncing      bool             `json:"syncing"`
+
+	// pending is the latest report not synced yet, a newer report replaces it
+	pending *report
+	// pendingEnv is the envelope of pending if the agent signed it
+	pendingEnv *signing.Envelope
+}
+
+// aggregator receives reports of agents and syncs them to NetBox with its own token.
+// Each host has at most one pending report and one running sync, workers bound the load on NetBox.
+type aggregator struct {
+	cfg     *config.Config
+	targets []syncTarget
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	tokens map[string]string
+	hosts  map[string]*hostStatus
+	queue  []string
+	closed bool
+}
+
+func newAggregator(cfg *config.Config) (*aggregator, error) {
+	targets, err := newTargets(cfg, false)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &aggregator{
+		cfg:     cfg,
+		targets: targets,
+		tokens:  map[string]string{},
+		hosts:   map[string]*hostStatus{},
+	}
+	a.cond = sync.NewCond(&a.mu)
+	return a, nil
+}
+
+// runServer runs the aggregator
+func runServer(args []string) int {
+	fs := newFlagSet("server")
+
+	cfg, code := setup(fs, args, true)
+	if cfg == nil {
+		return code
+	}
+	if err := cfg.ValidateServer(); err != nil {
+		log.Error(err)
+		return exitUsage
+	}
+
+	a, err := newAggregator(cfg)
+	if err != nil {
+		log.Error(err)
+		return exitUsage
+	}
+	if err := a.loadTokens(); err != nil {
+		log.Error(err)
+		return exitUsage
+	}
+
+	tlsConfig, err := serverTLSConfig(cfg.Server)
+	if err != nil {
+		log.Error(err)
+		return exitUsage
+	}
+
+	srv := &http.Server{
+		Addr:              cfg.Server.Listen,
+		Handler:           a.handler(),
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	listener, err := net.Listen("tcp", cfg.Server.Listen)
+	if err != nil {
+		log.Errorf("Error starting listener: %s", err)
+		return exitFailure
+	}
+
+	var workers sync.WaitGroup
+	for i := 0; i < cfg.Server.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			a.work()
+		}()
+	}
+
+	go func() {
+		if err := srv.ServeTLS(listener, cfg.Server.TLSCert, cfg.Server.TLSKey); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Error serving: %s", err)
+		}
+	}()
+	log.Infof("Aggregator listening on %s with %d workers", listener.Addr(), cfg.Server.Workers)
+	notify("READY=1")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			log.Info("Received SIGHUP, reloading tokens")
+			if err := a.loadTokens(); err != nil {
+				log.Errorf("Error reloading tokens, keeping the current ones: %s", err)
+			}
+			continue
+		}
+
+		log.Infof("Received %s, shutting down", sig)
+		notify("STOPPING=1")
+		break
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Errorf("Error shutting down: %s", err)
+	}
+
+	// Running syncs finish, queued reports are dropped, agents send them again
+	a.close()
+	workers.Wait()
+
+	return exitOK
+}
+
+// serverTLSConfig requests client certificates if client_ca is set.
+// They are optional at the TLS level so agents can still authenticate with a token.
+func serverTLSConfig(cfg config.ServerConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.ClientCA == "" {
+		return tlsConfig, nil
+	}
+
+	ca, err := os.ReadFile(cfg.ClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", cfg.ClientCA, err)
+	}
+	tlsConfig.ClientCAs = x509.NewCertPool()
+	if !tlsConfig.ClientCAs.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s", cfg.ClientCA)
+	}
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+
+	return tlsConfig, nil
+}
+
+// loadTokens reads the "hostname token" pairs of tokens_file
+func (a *aggregator) loadTokens() error {
+	if a.cfg.Server.TokensFile == "" {
+		return nil
+	}
+
+	f, err := os.Open(a.cfg.Server.TokensFile)
+	if err != nil {
+		return fmt.Errorf("error reading tokens: %v", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	tokens := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("error parsing %s line %d: expected hostname and token", a.cfg.Server.TokensFile, n)
+		}
+		tokens[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading tokens: %v", err)
+	}
+
+	a.mu.Lock()
+	a.tokens = tokens
+	a.mu.Unlock()
+
+	log.Infof("Loaded tokens of %d hosts", len(tokens))
+	return nil
+}
+
+func (a *aggregator) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v1/reports", a.receive)
+	mux.HandleFunc("GET /api/v1/hosts", a.authorizeStatus(a.listHosts))
+	mux.HandleFunc("GET /api/v1/hosts/{hostname}", a.authorizeStatus(a.getHost))
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
+
+// authenticated reports whether the request comes from hostname,
+// by a client certificate issued for it or by its token
+func (a *aggregator) authenticated(r *http.Request, hostname string) bool {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		if r.TLS.PeerCertificates[0].VerifyHostname(hostname) == nil {
+			return true
+		}
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+
+	a.mu.Lock()
+	expected, known := a.tokens[hostname]
+	a.mu.Unlock()
+
+	return known && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// receive queues a report for sync
+func (a *aggregator) receive(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxReportSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid report: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Agents with a signing key sign their reports, the signature is checked against the device when it is synced
+	var rep report
+	var env *signing.Envelope
+	if isSignedReport(data) {
+		var signed *report
+		env, signed, err = parseSignedReport(data, "report")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rep = *signed
+	} else {
+		// Agents may be newer than the aggregator, fields it doesn't know are ignored
+		if err := json.Unmarshal(data, &rep); err != nil {
+			http.Error(w, fmt.Sprintf("invalid report: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Authenticate before looking at the content, the hostname names the credentials
+	if rep.Host.Hostname == "" || !a.authenticated(r, rep.Host.Hostname) {
+		log.Warnf("Rejected report for %q from %s", rep.Host.Hostname, r.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := rep.validate(); err != nil {
+		http.Error(w, fmt.Sprintf("invalid report: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+
+	a.submit(&rep, env, r.RemoteAddr)
+	log.Infof("Received report of %s from %s", rep.Host.Hostname, r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, `{"queued":true}`)
+}
+
+// submit replaces the pending report of the host and queues the host unless it is queued or syncing already
+func (a *aggregator) submit(rep *report, env *signing.Envelope, remote string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	st, ok := a.hosts[rep.Host.Hostname]
+	if !ok {
+		st = &hostStatus{Hostname: rep.Host.Hostname}
+		a.hosts[rep.Host.Hostname] = st
+	}
+	st.pending, st.pendingEnv = rep, env
+	st.Remote = remote
+	st.AgentVersion = rep.Host.AgentVersion
+	st.CollectedAt = rep.Host.CollectedAt
+	st.LastReport = time.Now()
+
+	// A syncing host is queued again by its worker
+	if !st.Queued && !st.Syncing {
+		st.Queued = true
+		a.queue = append(a.queue, rep.Host.Hostname)
+		a.cond.Signal()
+	}
+}
+
+// work syncs queued hosts until the aggregator is closed
+func (a *aggregator) work() {
+	for {
+		a.mu.Lock()
+		for len(a.queue) == 0 && !a.closed {
+			a.cond.Wait()
+		}
+		if a.closed {
+			a.mu.Unlock()
+			return
+		}
+
+		hostname := a.queue[0]
+		a.queue = a.queue[1:]
+		st := a.hosts[hostname]
+		rep, env := st.pending, st.pendingEnv
+		st.pending, st.pendingEnv = nil, nil
+		st.Queued = false
+		st.Syncing = true
+		a.mu.Unlock()
+
+		var results []*targetSummary
+		var sets []targetChanges
+		changes, failures := 0, 0
+		for _, t := range a.targets {
+			s := t.syncer()
+			// The agent authenticated as the host, the key it signs with is enrolled on first use
+			s.enrollKeys = true
+			s.syncReport(rep, env, false)
+			observeSync(t.name, s)
+			log.WithField("target", t.name).Infof("Synced %s with %d changes and %d failures", hostname, len(s.changes), s.failures)
+
+			results = append(results, newTargetSummary(t.name, s))
+			sets = append(sets, targetChanges{Target: t.name, Changes: s.changes})
+			changes += len(s.changes)
+			failures += s.failures
+		}
+		notifyChanges(a.cfg, "server", hostname, sets)
+
+		a.mu.Lock()
+		st.Syncing = false
+		st.LastSync = time.Now()
+		st.Changes = changes
+		st.Failures = failures
+		st.Targets = results
+		st.Result = "success"
+		st.Error = ""
+		if failures > 0 {
+			st.Result = "failure"
+			st.Error = fmt.Sprintf("%d NetBox calls failed", failures)
+		}
+		if st.pending != nil && !a.closed {
+			st.Queued = true
+			a.queue = append(a.queue, hostname)
+			a.cond.Signal()
+		}
+		a.mu.Unlock()
+	}
+}
+
+// close stops the workers after their running sync
+func (a *aggregator) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.closed = true
+	a.cond.Broadcast()
+}
+
+// authorizeStatus requires status_token if it is set
+func (a *aggregator) authorizeStatus(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if expected := a.cfg.Server.StatusToken; expected != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// listHosts serves the status of all hosts sorted by hostname
+func (a *aggregator) listHosts(w http.ResponseWriter, _ *http.Request) {
+	a.mu.Lock()
+	hosts := make([]hostStatus, 0, len(a.hosts))
+	for _, st := range a.hosts {
+		hosts = append(hosts, *st)
+	}
+	a.mu.Unlock()
+
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Hostname < hosts[j].Hostname })
+	writeJSON(w, hosts)
+}
+
+// getHost serves the status of a single host
+func (a *aggregator) getHost(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	st, ok := a.hosts[r.PathValue("hostname")]
+	var host hostStatus
+	if ok {
+		host = *st
+	}
+	a.mu.Unlock()
+
+	if !ok {
+		http.Error(w, "unknown host", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, host)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, "error marshalling response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(append(data, '\n'))
+}
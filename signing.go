@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/iglov/netbox-agent/lib/config"
+	"github.com/iglov/netbox-agent/lib/signing"
+)
+
+// runExport writes the report of this host signed with its key, for hosts without a route to NetBox
+func runExport(args []string) int {
+	fs := newFlagSet("export")
+	output := fs.String("output", "-", "Write the signed report to this file instead of stdout.")
+	publicKey := fs.Bool("public-key", false, "Print the public key to store in the device custom field and exit.")
+
+	// Keep stdout clean for the signed report
+	log.Out = os.Stderr
+	logStdout = os.Stderr
+
+	cfg, code := setup(fs, args, false)
+	if cfg == nil {
+		return code
+	}
+
+	key, err := signing.LoadOrCreateKey(cfg.Signing.Key)
+	if err != nil {
+		log.Error(err)
+		return exitFailure
+	}
+	if *publicKey {
+		fmt.Println(signing.EncodePublicKey(key.Public().(ed25519.PublicKey)))
+		return exitOK
+	}
+
+	sum := newRunSummary(cfg, "export")
+
+	rep, err := inventoryReport(cfg, "", "")
+	if err != nil {
+		log.Error(err)
+		sum.collectionFailed(err)
+		return sum.finish()
+	}
+	sum.collected(&rep.Inventory)
+
+	// The signature covers the exact bytes of the report, they are kept as they are in the envelope
+	payload, err := json.Marshal(rep)
+	if err == nil {
+		err = writeJSONOutput(*output, signing.Sign(payload, key))
+	}
+	if err != nil {
+		log.Errorf("Error writing signed report: %s", err)
+		sum.failed(err)
+	}
+	return sum.finish()
+}
+
+// runImport syncs a signed report after checking it against the public key of its device in NetBox
+func runImport(args []string) int {
+	fs := newFlagSet("import")
+	from := fs.String("from", "", "Signed report written by export.")
+
+	cfg, code := setup(fs, args, true)
+	if cfg == nil {
+		return code
+	}
+	if *from == "" {
+		log.Error("import needs -from")
+		return exitUsage
+	}
+
+	lock, err := acquireLock(cfg.LockFile)
+	if err != nil {
+		log.Error(err)
+		return exitFailure
+	}
+	defer lock.release()
+
+	sum := newRunSummary(cfg, "import")
+
+	env, rep, err := readSignedReport(*from)
+	if err != nil {
+		log.Error(err)
+		sum.collectionFailed(err)
+		return sum.finish()
+	}
+	sum.collected(&rep.Inventory)
+
+	targets, err := newTargets(cfg, false)
+	if err != nil {
+		log.Error(err)
+		sum.failed(err)
+		return sum.finish()
+	}
+
+	var sets []targetChanges
+	for _, t := range targets {
+		s := t.syncer()
+		// Every target keeps its own copy of the public key
+		s.syncReport(rep, env, false)
+		sets = append(sets, targetChanges{Target: t.name, Changes: s.changes})
+		sum.syncResult(t.name, s)
+	}
+	notifyChanges(cfg, "import", rep.Host.Hostname, sets)
+	return sum.finish()
+}
+
+// readSignedReport reads a report written by export, its signature is not checked yet
+func readSignedReport(name string) (*signing.Envelope, *report, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading report: %v", err)
+	}
+	return parseSignedReport(data, name)
+}
+
+// parseSignedReport parses the signed report data read from name, its signature is not checked yet
+func parseSignedReport(data []byte, name string) (*signing.Envelope, *report, error) {
+	var env signing.Envelope
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&env); err != nil || env.Format != signing.Format {
+		return nil, nil, fmt.Errorf("%s is not a signed report, unsigned reports can't be imported", name)
+	}
+
+	// Reports of newer agents may have fields this one doesn't know
+	var rep report
+	if err := json.Unmarshal(env.Payload, &rep); err != nil {
+		return nil, nil, fmt.Errorf("error parsing %s: %v", name, err)
+	}
+	if err := rep.validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid report %s: %v", name, err)
+	}
+
+	return &env, &rep, nil
+}
+
+// isSignedReport reports whether data is a report written by export
+func isSignedReport(data []byte) bool {
+	var probe struct {
+		Format string `json:"format"`
+	}
+	return json.Unmarshal(data, &probe) == nil && probe.Format == signing.Format
+}
+
+// verifyReport checks the signature of a report against the public key in the custom field of its device
+func (s *syncer) verifyReport(env *signing.Envelope, rep *report) error {
+	host, err := resolveHost(s.cfg, rep.Host.Hostname, &rep.Inventory)
+	if err != nil {
+		return err
+	}
+
+	value, found, err := s.storedPublicKey(host.DeviceName)
+	if err != nil {
+		return err
+	}
+	enroll := s.enrollKeys && value == ""
+	switch {
+	case enroll:
+		// Trust on first use, the report has to be signed with the key it carries
+		value = env.PublicKey
+	case !found:
+		return fmt.Errorf("device %s is not in NetBox, its public key is unknown", host.DeviceName)
+	case value == "":
+		return fmt.Errorf("device %s has no public key in the custom field %s", host.DeviceName, s.cfg.Signing.CustomField)
+	}
+	key, err := signing.ParsePublicKey(value)
+	if err != nil {
+		return fmt.Errorf("device %s: %v", host.DeviceName, err)
+	}
+
+	if _, err := env.Verify(key); err != nil {
+		return fmt.Errorf("device %s: %v", host.DeviceName, err)
+	}
+	if enroll {
+		s.log.Infof("Enrolling the public key of %s", host.DeviceName)
+		s.enrolledKey = value
+	}
+	return nil
+}
+
+// syncReport syncs a report, collected on this host if local is set or received from elsewhere.
+// A signed report has to match the public key of its device, an unsigned one is refused if the device has a key.
+func (s *syncer) syncReport(rep *report, env *signing.Envelope, local bool) {
+	var err error
+	switch {
+	case env != nil:
+		err = s.verifyReport(env, rep)
+	case !local:
+		err = s.refuseUnsigned(rep)
+	}
+	if err != nil {
+		s.fail("dcim.device", fmt.Sprintf("Refusing report of %s", rep.Host.Hostname), err)
+		return
+	}
+	if !local {
+		// A report only writes the device named after its host, the blade chassis would be named after a serial of
+		// the report body
+		cfg := *s.cfg
+		cfg.Sync.Chassis = false
+		s.cfg = &cfg
+	}
+	s.syncInventory(rep.Host.Hostname, &rep.Inventory, local)
+}
+
+// refuseUnsigned returns an error if the device of an unsigned report has a public key, such a device is only updated
+// from reports signed with its key
+func (s *syncer) refuseUnsigned(rep *report) error {
+	host, err := resolveHost(s.cfg, rep.Host.Hostname, &rep.Inventory)
+	if err != nil {
+		return err
+	}
+
+	value, _, err := s.storedPublicKey(host.DeviceName)
+	if err != nil {
+		return err
+	}
+	if value != "" {
+		return fmt.Errorf("device %s has a public key in the custom field %s, it only takes reports signed with it (netbox-agent import)",
+			host.DeviceName, s.cfg.Signing.CustomField)
+	}
+	return nil
+}
+
+// storedPublicKey returns the public key in the custom field of the device, found is false if the device doesn't exist
+func (s *syncer) storedPublicKey(deviceName string) (value string, found bool, err error) {
+	deviceRes, _, err := s.c.DcimAPI.DcimDevicesList(s.ctx).Name([]string{deviceName}).Execute()
+	if err != nil {
+		return "", false, fmt.Errorf("error listing devices: %w", err)
+	}
+	debugResponse(deviceRes)
+
+	if len(deviceRes.Results) == 0 {
+		return "", false, nil
+	}
+	value, _ = deviceRes.Results[0].CustomFields[s.cfg.Signing.CustomField].(string)
+	return value, true, nil
+}
+
+// deviceCustomFields returns the custom fields the agent sets on the device of this host.
+// The public key is published once export created a key; for reports of other hosts only the key enrolled from the
+// report is. A key already stored in NetBox is the trust anchor of the device, another one only replaces it with
+// sync -rotate-key.
+func (s *syncer) deviceCustomFields(deviceName string, local bool) map[string]interface{} {
+	key := s.enrolledKey
+	if local {
+		key = hostPublicKey(s.cfg)
+	}
+	if key == "" {
+		return nil
+	}
+	stored, _, err := s.storedPublicKey(deviceName)
+	if err != nil {
+		s.log.Warnf("Not publishing the public key: %s", err)
+		return nil
+	}
+	if stored != "" && stored != key && !s.rotateKey {
+		s.log.Warnf("Device %s has another public key in %s, keeping it; run sync -rotate-key to replace it with the key of this host",
+			deviceName, s.cfg.Signing.CustomField)
+		return nil
+	}
+	return map[string]interface{}{s.cfg.Signing.CustomField: key}
+}
+
+// hostPublicKey returns the encoded public key of this host, empty if it has no key
+func hostPublicKey(cfg *config.Config) string {
+	if _, err := os.Stat(cfg.Signing.Key); errors.Is(err, os.ErrNotExist) {
+		return ""
+	}
+
+	key, err := signing.LoadOrCreateKey(cfg.Signing.Key)
+	if err != nil {
+		log.Warnf("Not publishing the public key: %s", err)
+		return ""
+	}
+	return signing.EncodePublicKey(key.Public().(ed25519.PublicKey))
+}
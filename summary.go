@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/iglov/netbox-agent/lib/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Results of a run, each has its own exit code
+const (
+	resultSuccess          = "success"
+	resultPartial          = "partial"
+	resultCollectionFailed = "collection_failed"
+	resultUnreachable      = "netbox_unreachable"
+	resultFailed           = "failed"
+)
+
+// objectCounts counts the outcome of a sync for one object type
+type objectCounts struct {
+	Created   int `json:"created"`
+	Updated   int `json:"updated"`
+	Deleted   int `json:"deleted"`
+	Unchanged int `json:"unchanged"`
+	Failed    int `json:"failed"`
+}
+
+// targetSummary is the outcome of the sync to one NetBox target
+type targetSummary struct {
+	Name    string                   `json:"name"`
+	DryRun  bool                     `json:"dry_run,omitempty"`
+	Result  string                   `json:"result"`
+	Changes int                      `json:"changes"`
+	Objects map[string]*objectCounts `json:"objects"`
+	// BIOSUpdates lists the devices whose BIOS was updated since the last sync
+	BIOSUpdates []biosUpdate `json:"bios_updates,omitempty"`
+}
+
+// runSummary is logged at the end of a run and written to output.summary
+type runSummary struct {
+	Command          string            `json:"command"`
+	RunID            string            `json:"run_id"`
+	Hostname         string            `json:"hostname"`
+	StartedAt        time.Time         `json:"started_at"`
+	FinishedAt       time.Time         `json:"finished_at"`
+	Result           string            `json:"result"`
+	ExitCode         int               `json:"exit_code"`
+	Targets          []*targetSummary  `json:"targets"`
+	FailedCollectors map[string]string `json:"failed_collectors,omitempty"`
+	Error            string            `json:"error,omitempty"`
+
+	cfg *config.Config
+}
+
+// collectorError is the error of a failed collector
+type collectorError struct {
+	collector string
+	err       error
+}
+
+func (e *collectorError) Error() string {
+	return e.err.Error()
+}
+
+func (e *collectorError) Unwrap() error {
+	return e.err
+}
+
+// unreachable reports whether err means the server could not be reached at all, as opposed to an API error
+func unreachable(err error) bool {
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+func newRunSummary(cfg *config.Config, command string) *runSummary {
+	sum := &runSummary{
+		Command:   command,
+		StartedAt: time.Now(),
+		Result:    resultSuccess,
+		ExitCode:  exitOK,
+		Targets:   []*targetSummary{},
+		cfg:       cfg,
+	}
+	if id, ok := logContext.get("run_id").(string); ok {
+		sum.RunID = id
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		sum.Hostname = hostname
+	}
+	return sum
+}
+
+// collectionFailed records that no inventory could be collected or read
+func (r *runSummary) collectionFailed(err error) {
+	r.Result, r.ExitCode = resultCollectionFailed, exitCollection
+	r.Error = err.Error()
+
+	var cerr *collectorError
+	if errors.As(err, &cerr) {
+		r.addCollectorError(cerr.collector, cerr.err.Error())
+	}
+}
+
+// collected records the collectors that failed, the run goes on with the inventory of the others
+func (r *runSummary) collected(inventory *FullSystemInfo) {
+	for name, status := range inventory.CollectionErrors {
+		if status.failed() {
+			r.addCollectorError(name, status.Error)
+		}
+	}
+	if len(r.FailedCollectors) > 0 && r.Result == resultSuccess {
+		r.Result, r.ExitCode = resultPartial, exitFailure
+	}
+}
+
+// failed records an error that ended the run, e.g. sending the report to the aggregator
+func (r *runSummary) failed(err error) {
+	r.Result, r.ExitCode = resultFailed, exitFailure
+	if unreachable(err) {
+		r.Result, r.ExitCode = resultUnreachable, exitUnreachable
+	}
+	r.Error = err.Error()
+}
+
+// newTargetSummary sums up the sync to a target, failures of only some objects are a partial result
+func newTargetSummary(target string, s *syncer) *targetSummary {
+	t := &targetSummary{Name: target, DryRun: s.dryRun, Result: resultSuccess, Changes: len(s.changes), Objects: s.objectCounts(), BIOSUpdates: s.biosUpdates}
+	switch {
+	case s.failures == 0:
+	case s.unreachable == s.failures:
+		t.Result = resultUnreachable
+	default:
+		t.Result = resultPartial
+	}
+	return t
+}
+
+// syncResult records the outcome of the sync to a target.
+// The run is unreachable if every target that failed could not be reached, otherwise partial.
+// A failed collector makes a run partial that would otherwise be successful.
+func (r *runSummary) syncResult(target string, s *syncer) {
+	r.Targets = append(r.Targets, newTargetSummary(target, s))
+	for name, message := range s.collectorErrors {
+		r.addCollectorError(name, message)
+	}
+
+	r.Result, r.ExitCode = resultSuccess, exitOK
+	for _, t := range r.Targets {
+		switch {
+		case t.Result == resultPartial:
+			r.Result, r.ExitCode = resultPartial, exitFailure
+		case t.Result == resultUnreachable && r.Result == resultSuccess:
+			r.Result, r.ExitCode = resultUnreachable, exitUnreachable
+		}
+	}
+	if r.Result == resultSuccess && len(r.FailedCollectors) > 0 {
+		r.Result, r.ExitCode = resultPartial, exitFailure
+	}
+}
+
+// changes returns the number of changes of all targets
+func (r *runSummary) changes() int {
+	n := 0
+	for _, t := range r.Targets {
+		n += t.Changes
+	}
+	return n
+}
+
+func (r *runSummary) addCollectorError(name, message string) {
+	if r.FailedCollectors == nil {
+		r.FailedCollectors = map[string]string{}
+	}
+	r.FailedCollectors[name] = message
+}
+
+// finish logs the summary, writes it to output.summary and returns the exit code of the run
+func (r *runSummary) finish() int {
+	r.FinishedAt = time.Now()
+
+	for _, t := range r.Targets {
+		objects := make([]string, 0, len(t.Objects))
+		for object := range t.Objects {
+			objects = append(objects, object)
+		}
+		sort.Strings(objects)
+
+		for _, object := range objects {
+			c := t.Objects[object]
+			log.WithFields(logrus.Fields{"target": t.Name, "object": object}).Infof("%s: %d created, %d updated, %d deleted, %d unchanged, %d failed",
+				object, c.Created, c.Updated, c.Deleted, c.Unchanged, c.Failed)
+		}
+		for _, u := range t.BIOSUpdates {
+			log.WithFields(logrus.Fields{"target": t.Name, "device": u.Device}).Infof("BIOS of %s was updated from %s to %s", u.Device, u.From, u.To)
+		}
+		if len(r.Targets) > 1 {
+			log.WithField("target", t.Name).Infof("Target %s finished with result %s and %d changes", t.Name, t.Result, t.Changes)
+		}
+	}
+	for name, message := range r.FailedCollectors {
+		log.WithField("collector", name).Errorf("Collector %s failed: %s", name, message)
+	}
+	log.WithField("result", r.Result).Infof("%s finished with result %s in %s",
+		r.Command, r.Result, r.FinishedAt.Sub(r.StartedAt).Round(time.Millisecond))
+
+	if r.cfg.Output.Summary != "" {
+		if err := r.write(r.cfg.Output.Summary); err != nil {
+			log.Errorf("Error writing summary: %s", err)
+		}
+	}
+	return r.ExitCode
+}
+
+func (r *runSummary) write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
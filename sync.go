@@ -0,0 +1,759 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/iglov/netbox-agent/lib/config"
+	"github.com/netbox-community/go-netbox/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// change is a single create, update or delete of a NetBox object
+type change struct {
+	Action string                 `json:"action"`
+	Object string                 `json:"object"`
+	Name   string                 `json:"name"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+// biosUpdate is a change of the BIOS version of a device, found in its bios_version custom field
+type biosUpdate struct {
+	Device string `json:"device"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+}
+
+// syncer writes the collected inventory to NetBox.
+// In dry run mode it only looks up existing objects and records the changes it would make.
+type syncer struct {
+	ctx      context.Context
+	c        *netbox.APIClient
+	cfg      *config.Config
+	dryRun   bool
+	changes  []change
+	failures int
+
+	// outcomes maps object type and name to the action taken (create, update, delete) or unchanged
+	outcomes map[string]map[string]string
+	// failed counts the failed NetBox calls per object type
+	failed map[string]int
+	// unreachable counts the failures where NetBox could not be reached at all
+	unreachable int
+	// collectorErrors holds the errors of the virtualization collectors run during the sync
+	collectorErrors map[string]string
+	// rotateKey replaces a public key stored on the device by the key of this host
+	rotateKey bool
+	// enrollKeys trusts the key of a signed report for a device without a key, the sender authenticated otherwise
+	enrollKeys bool
+	// enrolledKey is the key of the report being synced to store on its device, empty if there is none
+	enrolledKey string
+	// biosUpdates holds the devices whose BIOS version changed since the last sync
+	biosUpdates []biosUpdate
+	// log carries the target for the changes and failures
+	log *logrus.Entry
+}
+
+func newSyncer(ctx context.Context, c *netbox.APIClient, cfg *config.Config, dryRun bool) *syncer {
+	return &syncer{
+		ctx:             ctx,
+		c:               c,
+		cfg:             cfg,
+		dryRun:          dryRun,
+		outcomes:        map[string]map[string]string{},
+		failed:          map[string]int{},
+		collectorErrors: map[string]string{},
+		log:             logrus.NewEntry(log),
+	}
+}
+
+// record adds a change to the change set and reports whether it should be written to NetBox
+func (s *syncer) record(action, object, name string, fields map[string]interface{}) bool {
+	s.changes = append(s.changes, change{Action: action, Object: object, Name: name, Fields: fields})
+	s.setOutcome(object, name, action)
+
+	if s.dryRun {
+		s.log.Debugf("Would %s %s %s", action, object, name)
+		return false
+	}
+
+	s.log.Infof("%s %s %s", action, object, name)
+	return true
+}
+
+// unchanged counts an object that is up to date in NetBox
+func (s *syncer) unchanged(object, name string) {
+	s.setOutcome(object, name, "unchanged")
+}
+
+// setOutcome remembers what happened to an object, a change takes precedence over unchanged
+func (s *syncer) setOutcome(object, name, outcome string) {
+	if s.outcomes[object] == nil {
+		s.outcomes[object] = map[string]string{}
+	}
+	if prev, ok := s.outcomes[object][name]; ok && prev != "unchanged" {
+		return
+	}
+	s.outcomes[object][name] = outcome
+}
+
+// fail logs a failed NetBox call for an object type and counts it
+func (s *syncer) fail(object, message string, err error) {
+	s.failures++
+	s.failed[object]++
+	if unreachable(err) {
+		s.unreachable++
+	}
+	s.log.Errorf("%s: %v", message, err)
+}
+
+// failCollector logs a collector that failed during the sync and counts it
+func (s *syncer) failCollector(name, message string, err error) {
+	s.failures++
+	s.collectorErrors[name] = err.Error()
+	s.log.Errorf("%s: %v", message, err)
+}
+
+// objectCounts returns the outcome of the sync per object type
+func (s *syncer) objectCounts() map[string]*objectCounts {
+	counts := map[string]*objectCounts{}
+	get := func(object string) *objectCounts {
+		if counts[object] == nil {
+			counts[object] = &objectCounts{}
+		}
+		return counts[object]
+	}
+
+	for object, names := range s.outcomes {
+		c := get(object)
+		for _, outcome := range names {
+			switch outcome {
+			case "create":
+				c.Created++
+			case "update":
+				c.Updated++
+			case "delete":
+				c.Deleted++
+			default:
+				c.Unchanged++
+			}
+		}
+	}
+	for object, n := range s.failed {
+		get(object).Failed += n
+	}
+	return counts
+}
+
+// ownerTags returns the tag marking objects as owned by the agent
+func (s *syncer) ownerTags() []netbox.NestedTagRequest {
+	if s.cfg.Sync.OwnerTag == "" {
+		return nil
+	}
+	return []netbox.NestedTagRequest{{Name: s.cfg.Sync.OwnerTag, Slug: slugify(s.cfg.Sync.OwnerTag)}}
+}
+
+// debugResponse logs a decoded NetBox response at trace level, the HTTP call itself is logged by apiTransport
+func debugResponse(res interface{}) {
+	log.WithField("response", res).Trace("NetBox response")
+}
+
+// ensureTag creates the tag with description if it doesn't exist
+func (s *syncer) ensureTag(tag netbox.NestedTagRequest, description string) {
+	tagRes, _, err := s.c.ExtrasAPI.ExtrasTagsList(s.ctx).Slug([]string{tag.Slug}).Execute()
+	if err != nil {
+		s.fail("extras.tag", "Error listing tags", err)
+		return
+	}
+	debugResponse(tagRes)
+
+	if len(tagRes.Results) > 0 {
+		s.unchanged("extras.tag", tag.Name)
+		return
+	}
+	if !s.record("create", "extras.tag", tag.Name, nil) {
+		return
+	}
+
+	tagRequest := netbox.NewTagRequestWithDefaults()
+	tagRequest.SetName(tag.Name)
+	tagRequest.SetSlug(tag.Slug)
+	if description != "" {
+		tagRequest.SetDescription(description)
+	}
+	tagCreateRes, _, err := s.c.ExtrasAPI.ExtrasTagsCreate(s.ctx).TagRequest(*tagRequest).Execute()
+	if err != nil {
+		s.fail("extras.tag", "Error creating tag", err)
+		return
+	}
+	debugResponse(tagCreateRes)
+}
+
+// ensureSite creates the site if it doesn't exist
+func (s *syncer) ensureSite(name, slug string) {
+	siteRes, _, err := s.c.DcimAPI.DcimSitesList(s.ctx).Slug([]string{slug}).Execute()
+	if err != nil {
+		s.fail("dcim.site", "Error listing sites", err)
+		return
+	}
+	debugResponse(siteRes)
+
+	if len(siteRes.Results) > 0 {
+		s.unchanged("dcim.site", name)
+		return
+	}
+	if !s.record("create", "dcim.site", name, nil) {
+		return
+	}
+
+	siteRequest := netbox.NewWritableSiteRequestWithDefaults()
+	siteRequest.SetName(name)
+	siteRequest.SetSlug(slug)
+	siteRequest.SetDescription("It's just a default Site after server creation by API, it should be changed after server creation.")
+	siteCreateRes, _, err := s.c.DcimAPI.DcimSitesCreate(s.ctx).WritableSiteRequest(*siteRequest).Execute()
+	if err != nil {
+		s.fail("dcim.site", "Error creating site", err)
+		return
+	}
+	debugResponse(siteCreateRes)
+}
+
+// ensureRole creates the device role if it doesn't exist
+func (s *syncer) ensureRole(role config.ObjectConfig) {
+	roleRes, _, err := s.c.DcimAPI.DcimDeviceRolesList(s.ctx).Slug([]string{role.Slug}).Execute()
+	if err != nil {
+		s.fail("dcim.devicerole", "Error listing roles", err)
+		return
+	}
+	debugResponse(roleRes)
+
+	if len(roleRes.Results) > 0 {
+		s.unchanged("dcim.devicerole", role.Name)
+		return
+	}
+	if !s.record("create", "dcim.devicerole", role.Name, nil) {
+		return
+	}
+
+	roleRequest := netbox.NewDeviceRoleRequestWithDefaults()
+	roleRequest.SetName(role.Name)
+	roleRequest.SetSlug(role.Slug)
+	roleRequest.SetDescription("It's just a default role after server creation by API, it should be changed after server creation.")
+	roleCreateRes, _, err := s.c.DcimAPI.DcimDeviceRolesCreate(s.ctx).DeviceRoleRequest(*roleRequest).Execute()
+	if err != nil {
+		s.fail("dcim.devicerole", "Error creating role", err)
+		return
+	}
+	debugResponse(roleCreateRes)
+}
+
+// ensureManufacturer creates the manufacturer if it doesn't exist and returns a reference to it
+func (s *syncer) ensureManufacturer(name string) netbox.ManufacturerRequest {
+	man := netbox.ManufacturerRequest{Name: name, Slug: slugify(name)}
+
+	manRes, _, err := s.c.DcimAPI.DcimManufacturersList(s.ctx).Slug([]string{man.Slug}).Execute()
+	if err != nil {
+		s.fail("dcim.manufacturer", "Error listing manufacturers", err)
+		return man
+	}
+	debugResponse(manRes)
+
+	if len(manRes.Results) > 0 {
+		// Refer to the existing object by its name in NetBox
+		man.Name = manRes.Results[0].Name
+		s.unchanged("dcim.manufacturer", name)
+		return man
+	}
+	if !s.record("create", "dcim.manufacturer", name, nil) {
+		return man
+	}
+
+	manCreateRes, _, err := s.c.DcimAPI.DcimManufacturersCreate(s.ctx).ManufacturerRequest(man).Execute()
+	if err != nil {
+		s.fail("dcim.manufacturer", "Error creating manufacturer", err)
+		return man
+	}
+	debugResponse(manCreateRes)
+
+	return man
+}
+
+// ensureDeviceType creates the device type and its manufacturer if they don't exist
+func (s *syncer) ensureDeviceType(model, vendor string) netbox.DeviceTypeRequest {
+	man := s.ensureManufacturer(vendor)
+	deviceType := netbox.DeviceTypeRequest{Model: model, Slug: man.Slug + "-" + slugify(model), Manufacturer: man}
+
+	typeRes, _, err := s.c.DcimAPI.DcimDeviceTypesList(s.ctx).Slug([]string{deviceType.Slug}).Execute()
+	if err != nil {
+		s.fail("dcim.devicetype", "Error listing device types", err)
+		return deviceType
+	}
+	debugResponse(typeRes)
+
+	if len(typeRes.Results) > 0 {
+		deviceType.Model = typeRes.Results[0].Model
+		s.unchanged("dcim.devicetype", model)
+		return deviceType
+	}
+	if !s.record("create", "dcim.devicetype", model, nil) {
+		return deviceType
+	}
+
+	typeRequest := netbox.NewWritableDeviceTypeRequestWithDefaults()
+	typeRequest.SetManufacturer(man)
+	typeRequest.SetModel(model)
+	typeRequest.SetSlug(deviceType.Slug)
+	typeCreateRes, _, err := s.c.DcimAPI.DcimDeviceTypesCreate(s.ctx).WritableDeviceTypeRequest(*typeRequest).Execute()
+	if err != nil {
+		s.fail("dcim.devicetype", "Error creating device type", err)
+		return deviceType
+	}
+	debugResponse(typeCreateRes)
+
+	return deviceType
+}
+
+// deviceSpec describes the wanted state of a device
+type deviceSpec struct {
+	Name         string
+	Serial       string
+	Comments     string
+	Site         string
+	Role         config.ObjectConfig
+	Tenant       config.ObjectConfig
+	Model        string
+	Vendor       string
+	LocalContext interface{}
+	CustomFields map[string]interface{}
+}
+
+// syncDevice creates or updates the device and returns its id, 0 if it doesn't exist (yet)
+func (s *syncer) syncDevice(spec deviceSpec) int32 {
+	deviceType := s.ensureDeviceType(spec.Model, spec.Vendor)
+	siteSlug := slugify(spec.Site)
+
+	deviceRes, _, err := s.c.DcimAPI.DcimDevicesList(s.ctx).Name([]string{spec.Name}).Execute()
+	if err != nil {
+		s.fail("dcim.device", "Error listing devices", err)
+		return 0
+	}
+	debugResponse(deviceRes)
+
+	if len(deviceRes.Results) == 0 {
+		if !s.record("create", "dcim.device", spec.Name, map[string]interface{}{"serial": spec.Serial, "device_type": deviceType.Slug, "site": siteSlug}) {
+			return 0
+		}
+
+		device := netbox.NewWritableDeviceWithConfigContextRequestWithDefaults()
+		device.SetSite(netbox.SiteRequest{Name: spec.Site, Slug: siteSlug})
+		device.SetRole(netbox.DeviceRoleRequest{Name: spec.Role.Name, Slug: spec.Role.Slug})
+		if spec.Tenant.Name != "" {
+			device.SetTenant(netbox.TenantRequest{Name: spec.Tenant.Name, Slug: spec.Tenant.Slug})
+		}
+		device.SetComments(spec.Comments)
+		device.SetDeviceType(deviceType)
+		device.SetName(spec.Name)
+		device.SetSerial(spec.Serial)
+		if spec.LocalContext != nil {
+			device.SetLocalContextData(spec.LocalContext)
+		}
+		if len(spec.CustomFields) > 0 {
+			device.SetCustomFields(spec.CustomFields)
+		}
+		device.SetTags(s.ownerTags())
+
+		deviceCreateRes, _, err := s.c.DcimAPI.DcimDevicesCreate(s.ctx).WritableDeviceWithConfigContextRequest(*device).Execute()
+		if err != nil {
+			s.fail("dcim.device", "Error creating device", err)
+			return 0
+		}
+		debugResponse(deviceCreateRes)
+
+		return deviceCreateRes.Id
+	}
+
+	dev := deviceRes.Results[0]
+	patch := netbox.NewPatchedWritableDeviceWithConfigContextRequestWithDefaults()
+	fields := map[string]interface{}{}
+
+	if dev.GetSerial() != spec.Serial {
+		patch.SetSerial(spec.Serial)
+		fields["serial"] = spec.Serial
+	}
+	if dev.GetComments() != spec.Comments {
+		patch.SetComments(spec.Comments)
+		fields["comments"] = spec.Comments
+	}
+	if dev.Site.Slug != siteSlug {
+		patch.SetSite(netbox.SiteRequest{Name: spec.Site, Slug: siteSlug})
+		fields["site"] = siteSlug
+	}
+	if dev.DeviceType.Slug != deviceType.Slug {
+		patch.SetDeviceType(deviceType)
+		fields["device_type"] = deviceType.Slug
+	}
+	if spec.Tenant.Name != "" && dev.GetTenant().Slug != spec.Tenant.Slug {
+		patch.SetTenant(netbox.TenantRequest{Name: spec.Tenant.Name, Slug: spec.Tenant.Slug})
+		fields["tenant"] = spec.Tenant.Slug
+	}
+	if spec.LocalContext != nil && !jsonEqual(dev.LocalContextData, spec.LocalContext) {
+		patch.SetLocalContextData(spec.LocalContext)
+		fields["local_context_data"] = "(changed)"
+	}
+	for name, value := range spec.CustomFields {
+		// NetBox merges the custom fields of a patch with the existing ones
+		if fmt.Sprint(dev.CustomFields[name]) != fmt.Sprint(value) {
+			patch.SetCustomFields(spec.CustomFields)
+			fields[name] = value
+		}
+	}
+	// A device that had a BIOS version before got a BIOS update
+	if old, ok := dev.CustomFields[biosVersionField].(string); ok && old != "" && fields[biosVersionField] != nil {
+		s.biosUpdates = append(s.biosUpdates, biosUpdate{Device: spec.Name, From: old, To: fmt.Sprint(fields[biosVersionField])})
+	}
+
+	if len(fields) == 0 {
+		s.unchanged("dcim.device", spec.Name)
+		return dev.Id
+	}
+	if !s.record("update", "dcim.device", spec.Name, fields) {
+		return dev.Id
+	}
+
+	patchRes, _, err := s.c.DcimAPI.DcimDevicesPartialUpdate(s.ctx, dev.Id).PatchedWritableDeviceWithConfigContextRequest(*patch).Execute()
+	if err != nil {
+		s.fail("dcim.device", "Error updating device", err)
+		return dev.Id
+	}
+	debugResponse(patchRes)
+
+	return dev.Id
+}
+
+// inventoryItem describes the wanted state of an inventory item.
+// Items are matched by name and label, the label holds the slot of the component.
+type inventoryItem struct {
+	Name         string
+	Label        string
+	Manufacturer string
+	PartID       string
+	Serial       string
+	CustomFields map[string]interface{}
+}
+
+func (i inventoryItem) key() string {
+	return i.Name + "/" + i.Label
+}
+
+// syncInventoryItems creates and updates the inventory items of the device.
+// Items owned by the agent that are no longer present are deleted, unless their kind is incomplete because its collector failed.
+func (s *syncer) syncInventoryItems(deviceID int32, deviceName string, items []inventoryItem, incomplete func(name string) bool) {
+	existing := map[string]netbox.InventoryItem{}
+
+	if deviceID != 0 {
+		invRes, _, err := s.c.DcimAPI.DcimInventoryItemsList(s.ctx).DeviceId([]int32{deviceID}).Limit(1000).Execute()
+		if err != nil {
+			s.fail("dcim.inventoryitem", "Error listing inventory items", err)
+			return
+		}
+		debugResponse(invRes)
+
+		for _, inv := range invRes.Results {
+			existing[inv.Name+"/"+inv.GetLabel()] = inv
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, item := range items {
+		seen[item.key()] = true
+		known, ok := existing[item.key()]
+
+		if !ok {
+			if !s.record("create", "dcim.inventoryitem", item.key(), map[string]interface{}{"serial": item.Serial, "part_id": item.PartID}) {
+				continue
+			}
+
+			inv := netbox.NewInventoryItemRequestWithDefaults()
+			inv.SetName(item.Name)
+			inv.SetLabel(item.Label)
+			if item.Manufacturer != "" {
+				inv.SetManufacturer(s.ensureManufacturer(item.Manufacturer))
+			}
+			inv.SetPartId(item.PartID)
+			inv.SetSerial(item.Serial)
+			inv.SetCustomFields(item.CustomFields)
+			inv.SetDevice(netbox.DeviceRequest{Name: *netbox.NewNullableString(&deviceName)})
+			inv.SetTags(s.ownerTags())
+
+			invRes, _, err := s.c.DcimAPI.DcimInventoryItemsCreate(s.ctx).InventoryItemRequest(*inv).Execute()
+			if err != nil {
+				s.fail("dcim.inventoryitem", "Error creating inventory item", err)
+				continue
+			}
+			debugResponse(invRes)
+			continue
+		}
+
+		patch := netbox.NewPatchedInventoryItemRequestWithDefaults()
+		fields := map[string]interface{}{}
+
+		if known.GetSerial() != item.Serial {
+			patch.SetSerial(item.Serial)
+			fields["serial"] = item.Serial
+		}
+		if known.GetPartId() != item.PartID {
+			patch.SetPartId(item.PartID)
+			fields["part_id"] = item.PartID
+		}
+		if item.Manufacturer != "" && known.GetManufacturer().Slug != slugify(item.Manufacturer) {
+			patch.SetManufacturer(s.ensureManufacturer(item.Manufacturer))
+			fields["manufacturer"] = item.Manufacturer
+		}
+		for name, value := range item.CustomFields {
+			if fmt.Sprint(known.CustomFields[name]) != fmt.Sprint(value) {
+				patch.SetCustomFields(item.CustomFields)
+				fields[name] = value
+			}
+		}
+
+		if len(fields) == 0 {
+			s.unchanged("dcim.inventoryitem", item.key())
+			continue
+		}
+		if !s.record("update", "dcim.inventoryitem", item.key(), fields) {
+			continue
+		}
+
+		patchRes, _, err := s.c.DcimAPI.DcimInventoryItemsPartialUpdate(s.ctx, known.Id).PatchedInventoryItemRequest(*patch).Execute()
+		if err != nil {
+			s.fail("dcim.inventoryitem", "Error updating inventory item", err)
+			continue
+		}
+		debugResponse(patchRes)
+	}
+
+	for key, inv := range existing {
+		if seen[key] || incomplete(inv.Name) || !hasTag(inv.Tags, s.cfg.Sync.OwnerTag) {
+			continue
+		}
+		if !s.record("delete", "dcim.inventoryitem", key, nil) {
+			continue
+		}
+
+		_, err := s.c.DcimAPI.DcimInventoryItemsDestroy(s.ctx, inv.Id).Execute()
+		if err != nil {
+			s.fail("dcim.inventoryitem", "Error deleting inventory item", err)
+			continue
+		}
+	}
+}
+
+// syncInterface creates the interface of the device if it doesn't exist
+func (s *syncer) syncInterface(deviceID int32, deviceName, name, ifType string) {
+	if deviceID != 0 {
+		ifRes, _, err := s.c.DcimAPI.DcimInterfacesList(s.ctx).DeviceId([]int32{deviceID}).Name([]string{name}).Execute()
+		if err != nil {
+			s.fail("dcim.interface", "Error listing interfaces", err)
+			return
+		}
+		debugResponse(ifRes)
+
+		if len(ifRes.Results) > 0 {
+			s.unchanged("dcim.interface", deviceName+"/"+name)
+			return
+		}
+	}
+
+	if !s.record("create", "dcim.interface", deviceName+"/"+name, nil) {
+		return
+	}
+
+	netInt := netbox.NewWritableInterfaceRequestWithDefaults()
+	netInt.SetName(name)
+	netInt.SetDevice(netbox.DeviceRequest{Name: *netbox.NewNullableString(&deviceName)})
+	netInt.SetType(netbox.InterfaceTypeValue(ifType))
+	netInt.SetTags(s.ownerTags())
+
+	netIntRes, _, err := s.c.DcimAPI.DcimInterfacesCreate(s.ctx).WritableInterfaceRequest(*netInt).Execute()
+	if err != nil {
+		s.fail("dcim.interface", "Error creating interface", err)
+		return
+	}
+	debugResponse(netIntRes)
+}
+
+// hasTag reports whether the tag list contains the tag with the given name
+func hasTag(tags []netbox.NestedTag, name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, tag := range tags {
+		if tag.Name == name || tag.Slug == slugify(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonEqual compares two values by their JSON representation
+func jsonEqual(a, b interface{}) bool {
+	var va, vb interface{}
+
+	da, err := json.Marshal(a)
+	if err != nil || json.Unmarshal(da, &va) != nil {
+		return false
+	}
+	db, err := json.Marshal(b)
+	if err != nil || json.Unmarshal(db, &vb) != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(va, vb)
+}
+
+// hostIdentity is the site and names of the device derived from the host and its inventory
+type hostIdentity struct {
+	Site       string
+	DeviceName string
+}
+
+// resolveHost resolves the site and the device name of a host
+func resolveHost(cfg *config.Config, hostname string, fullSystemInfo *FullSystemInfo) (hostIdentity, error) {
+	if len(fullSystemInfo.System) == 0 {
+		return hostIdentity{}, fmt.Errorf("no system information for %s", hostname)
+	}
+
+	site, err := resolveSite(cfg, hostname)
+	if err != nil {
+		return hostIdentity{}, fmt.Errorf("error resolving site: %s", err)
+	}
+
+	return hostIdentity{Site: site, DeviceName: resolveDeviceName(cfg, hostname, fullSystemInfo.System[0].SerialNumber)}, nil
+}
+
+// customFields returns the custom fields of the device: those of the sync mappers, then of the plugins and then of the
+// agent itself, a later one wins a clash
+func (s *syncer) customFields(deviceName string, fullSystemInfo *FullSystemInfo, local bool) map[string]interface{} {
+	var fields map[string]interface{}
+	for _, m := range syncMappers {
+		if m.customFields != nil {
+			fields = mergeFields(fields, m.customFields(s, fullSystemInfo))
+		}
+	}
+	fields = mergeFields(fields, pluginCustomFields(fullSystemInfo))
+	return mergeFields(fields, s.deviceCustomFields(deviceName, local))
+}
+
+// syncInventory writes the device of the host and its components to NetBox.
+// Clusters and guests are read from the host the agent runs on, they are only synced if local is set.
+func (s *syncer) syncInventory(hostname string, fullSystemInfo *FullSystemInfo, local bool) {
+	host, err := resolveHost(s.cfg, hostname, fullSystemInfo)
+	if err != nil {
+		s.fail("dcim.device", "Error resolving device", err)
+		return
+	}
+
+	if tags := s.ownerTags(); len(tags) > 0 {
+		s.ensureTag(tags[0], "")
+	}
+	if s.cfg.Sync.CreateRole {
+		s.ensureRole(s.cfg.Resolution.Role)
+	}
+	if s.cfg.Sync.CreateSite {
+		s.ensureSite(host.Site, slugify(host.Site))
+	}
+
+	productName := fullSystemInfo.System[0].ProductName
+	productVendor := fullSystemInfo.System[0].Manufacturer
+	productSerial := fullSystemInfo.System[0].SerialNumber
+	chassisVersion := productName
+	chassisSerial := productSerial
+	chassisVendor := productVendor
+	if len(fullSystemInfo.Chassis) > 0 {
+		chassisVersion = fullSystemInfo.Chassis[0].Version
+		chassisSerial = fullSystemInfo.Chassis[0].SerialNumber
+		chassisVendor = fullSystemInfo.Chassis[0].Manufacturer
+	}
+
+	otherInfo := "Serial: " + productSerial + " | Chassis name: " + chassisVersion + " | Chassis serial: " + chassisSerial + " | Chassis vendor: " + chassisVendor
+
+	// Add blade chassis if exists
+	if s.cfg.Sync.Chassis && chassisSerial != productSerial {
+		s.syncDevice(deviceSpec{
+			Name:     chassisSerial,
+			Serial:   chassisSerial,
+			Comments: otherInfo,
+			Site:     host.Site,
+			Role:     s.cfg.Resolution.Role,
+			Tenant:   s.cfg.Resolution.Tenant,
+			Model:    chassisVersion,
+			Vendor:   chassisVendor,
+		})
+	}
+
+	deviceID := s.syncDevice(deviceSpec{
+		Name:         host.DeviceName,
+		Serial:       productSerial,
+		Comments:     otherInfo,
+		Site:         host.Site,
+		Role:         s.cfg.Resolution.Role,
+		Tenant:       s.cfg.Resolution.Tenant,
+		Model:        productName,
+		Vendor:       productVendor,
+		LocalContext: fullSystemInfo,
+		CustomFields: s.customFields(host.DeviceName, fullSystemInfo, local),
+	})
+
+	if s.cfg.Sync.InventoryItems {
+		var items []inventoryItem
+		// Items of a failed collector are missing from the inventory, they must not be deleted
+		failed := map[string]bool{}
+		for _, m := range syncMappers {
+			if m.items == nil {
+				continue
+			}
+			items = append(items, m.items(fullSystemInfo)...)
+			failed[m.itemName] = fullSystemInfo.collectorFailed(m.collector)
+		}
+		items = append(items, pluginItems(fullSystemInfo)...)
+		// Plugins name their items freely, so if one failed every item that isn't built in is kept
+		pluginFailed := fullSystemInfo.pluginFailed()
+		incomplete := func(name string) bool {
+			if isFailed, builtIn := failed[name]; builtIn {
+				return isFailed
+			}
+			return pluginFailed
+		}
+		s.syncInventoryItems(deviceID, host.DeviceName, items, incomplete)
+	}
+
+	for _, m := range syncMappers {
+		if m.sync != nil {
+			m.sync(s, deviceID, host.DeviceName, fullSystemInfo)
+		}
+	}
+
+	if !local {
+		return
+	}
+
+	// A device is a member of one cluster only, the others are left alone
+	member := s.clusterMember()
+
+	// Add libvirt guests if this host is a hypervisor
+	if s.cfg.Collectors.Libvirt.Enabled {
+		s.syncLibvirt(host.DeviceName, host.Site, member == "libvirt")
+	}
+
+	// Add Proxmox VE cluster membership and guests if this host is a node
+	if s.cfg.Collectors.Proxmox.Enabled {
+		s.syncProxmox(host.DeviceName, host.Site, member == "proxmox")
+	}
+
+	// Add Kubernetes cluster membership if this host runs a kubelet
+	if s.cfg.Collectors.Kubernetes.Enabled {
+		s.syncKubernetes(host.DeviceName, host.Site, member == "kubernetes")
+	}
+}
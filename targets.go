@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/iglov/netbox-agent/lib/config"
+	"github.com/netbox-community/go-netbox/v4"
+)
+
+// syncTarget is a NetBox instance with its own client, connection settings and sync policy
+type syncTarget struct {
+	name   string
+	cfg    *config.Config
+	c      *netbox.APIClient
+	dryRun bool
+}
+
+// newTargets creates the clients of the NetBox targets, all of them run in dry run mode if dryRun is set
+func newTargets(cfg *config.Config, dryRun bool) ([]syncTarget, error) {
+	var targets []syncTarget
+	for _, t := range cfg.NetBoxTargets() {
+		targetCfg := *cfg
+		targetCfg.NetBox, targetCfg.Sync = t.NetBox, t.Sync
+
+		c, err := newClient(&targetCfg, t.Name)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %v", t.Name, err)
+		}
+		targets = append(targets, syncTarget{name: t.Name, cfg: &targetCfg, c: c, dryRun: dryRun || t.Mode == "plan"})
+	}
+	return targets, nil
+}
+
+// syncer returns a syncer writing to the target
+func (t syncTarget) syncer() *syncer {
+	s := newSyncer(context.Background(), t.c, t.cfg, t.dryRun)
+	s.log = s.log.WithField("target", t.name)
+	return s
+}
+
+// targetNames returns the names the results of a run are reported under
+func targetNames(cfg *config.Config) []string {
+	if cfg.Aggregator.URL != "" {
+		return []string{"aggregator"}
+	}
+
+	var names []string
+	for _, t := range cfg.NetBoxTargets() {
+		names = append(names, t.Name)
+	}
+	return names
+}
+
+// targetChanges is the change set of one target
+type targetChanges struct {
+	Target  string   `json:"target"`
+	Changes []change `json:"changes"`
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iglov/netbox-agent/lib/config"
+	"github.com/iglov/netbox-agent/lib/metrics"
+)
+
+// writeTextfile writes the inventory and the status of this run for the node_exporter textfile collector.
+// The file is replaced atomically so node_exporter never reads a partial file.
+func writeTextfile(path, command string, fullSystemInfo *FullSystemInfo, success bool) error {
+	r := metrics.NewRegistry()
+
+	r.Describe("netbox_agent_last_run_timestamp_seconds", metrics.Gauge, "Time the agent last ran.")
+	r.Describe("netbox_agent_last_run_success", metrics.Gauge, "Whether the last run of the agent succeeded.")
+	r.Describe("netbox_agent_system_info", metrics.Gauge, "System vendor, product and serial number.")
+	r.Describe("netbox_agent_bios_info", metrics.Gauge, "BIOS vendor, version and release date.")
+	r.Describe("netbox_agent_bmc_info", metrics.Gauge, "BMC firmware and IPMI version.")
+	r.Describe("netbox_agent_memory_module_info", metrics.Gauge, "Installed memory module by slot.")
+	r.Describe("netbox_agent_memory_module_size_bytes", metrics.Gauge, "Size of the memory module by slot.")
+	r.Describe("netbox_agent_disk_info", metrics.Gauge, "Detected disk by slot.")
+	r.Describe("netbox_agent_disk_size_bytes", metrics.Gauge, "Size of the disk by slot.")
+
+	success01 := 0.0
+	if success {
+		success01 = 1
+	}
+	r.Set("netbox_agent_last_run_timestamp_seconds", metrics.Labels{"command": command}, float64(time.Now().Unix()))
+	r.Set("netbox_agent_last_run_success", metrics.Labels{"command": command}, success01)
+
+	if fullSystemInfo != nil {
+		inventoryMetrics(r, fullSystemInfo)
+	}
+
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, buf.Bytes())
+}
+
+// writeFileAtomic replaces the file at path, readers see either the old or the new content
+func writeFileAtomic(path string, data []byte) error {
+	// The temporary file has to be in the same directory for the rename to be atomic
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("error writing %s: %v", path, err)
+	}
+	// Nothing is left to remove once the file was renamed
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("error writing %s: %v", path, err)
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("error writing %s: %v", path, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("error writing %s: %v", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing %s: %v", path, err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error writing %s: %v", path, err)
+	}
+	return nil
+}
+
+// inventoryMetrics adds info style series for the inventory.
+// Only identifying details become labels, sizes are separate series, so a host has a few dozen series at most.
+func inventoryMetrics(r *metrics.Registry, fullSystemInfo *FullSystemInfo) {
+	for _, system := range fullSystemInfo.System {
+		r.Set("netbox_agent_system_info", metrics.Labels{
+			"vendor":  system.Manufacturer,
+			"product": system.ProductName,
+			"serial":  system.SerialNumber,
+		}, 1)
+	}
+
+	for _, bios := range fullSystemInfo.BIOS {
+		r.Set("netbox_agent_bios_info", metrics.Labels{
+			"vendor":  bios.Vendor,
+			"version": bios.Version,
+			"date":    bios.ReleaseDate,
+		}, 1)
+	}
+
+	if bmc := fullSystemInfo.IPMI; bmc.FwRev != "" {
+		r.Set("netbox_agent_bmc_info", metrics.Labels{
+			"firmware":        bmc.FwRev,
+			"ipmi_version":    bmc.IpmiVer,
+			"manufacturer_id": bmc.ManID,
+		}, 1)
+	}
+
+	for _, mem := range fullSystemInfo.Memory {
+		r.Set("netbox_agent_memory_module_info", metrics.Labels{
+			"slot":         mem.DeviceLocator,
+			"manufacturer": mem.Manufacturer,
+			"part_number":  strings.TrimSpace(mem.PartNumber),
+			"serial":       mem.SerialNumber,
+			"type":         mem.Type,
+		}, 1)
+		r.Set("netbox_agent_memory_module_size_bytes", metrics.Labels{"slot": mem.DeviceLocator}, memoryBytes(mem))
+	}
+
+	for _, disk := range fullSystemInfo.Storage {
+		slot := disk.Slot
+		if slot == "" {
+			slot = disk.Name
+		}
+		r.Set("netbox_agent_disk_info", metrics.Labels{
+			"slot":   slot,
+			"model":  disk.Model,
+			"serial": disk.SerialNumber,
+		}, 1)
+		if size, ok := parseSizeBytes(disk.Size); ok {
+			r.Set("netbox_agent_disk_size_bytes", metrics.Labels{"slot": slot}, size)
+		}
+	}
+}
+
+var sizeUnits = map[string]float64{
+	"B":  1,
+	"KB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+	"TB": 1 << 40,
+	"PB": 1 << 50,
+}
+
+// parseSizeBytes parses sizes such as "1.090 TB" or "480.000 GB" as reported by the storage collector
+func parseSizeBytes(size string) (float64, bool) {
+	fields := strings.Fields(size)
+	if len(fields) != 2 {
+		return 0, false
+	}
+
+	number, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, false
+	}
+	unit, ok := sizeUnits[strings.ToUpper(fields[1])]
+	if !ok {
+		return 0, false
+	}
+	return number * unit, true
+}
+
+// reportRun writes the textfile if output.textfile is set
+func reportRun(cfg *config.Config, command string, fullSystemInfo *FullSystemInfo, success bool) {
+	if cfg.Output.Textfile == "" {
+		return
+	}
+	if err := writeTextfile(cfg.Output.Textfile, command, fullSystemInfo, success); err != nil {
+		log.Errorf("Error writing textfile: %s", err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iglov/netbox-agent/lib/config"
+)
+
+// warnedTokenFiles remembers the token files already reported as world-readable
+var warnedTokenFiles sync.Map
+
+// tokenSource provides the NetBox token from the config, a file, a systemd credential or a helper command.
+// Files are read again when they change, the command runs again after NetBox rejected the token.
+type tokenSource struct {
+	cfg  config.NetBoxConfig
+	path string
+
+	mu      sync.Mutex
+	token   string
+	modTime time.Time
+	size    int64
+}
+
+func newTokenSource(cfg config.NetBoxConfig) (*tokenSource, error) {
+	ts := &tokenSource{cfg: cfg}
+
+	switch {
+	case cfg.Token != "":
+	case cfg.TokenFile != "":
+		ts.path = cfg.TokenFile
+	case cfg.CredentialPath() != "":
+		ts.path = cfg.CredentialPath()
+	case cfg.TokenCommand != "":
+	default:
+		return nil, fmt.Errorf("no NetBox token configured")
+	}
+
+	if ts.path != "" {
+		warnWorldReadable(ts.path)
+	}
+	if _, err := ts.get(); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// get returns the current token
+func (ts *tokenSource) get() (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	switch {
+	case ts.cfg.Token != "":
+		return ts.cfg.Token, nil
+	case ts.path != "":
+		return ts.readFile()
+	default:
+		return ts.runCommand()
+	}
+}
+
+// readFile reads the token file if it changed since it was read last
+func (ts *tokenSource) readFile() (string, error) {
+	info, err := os.Stat(ts.path)
+	if err != nil {
+		return "", fmt.Errorf("error reading token: %v", err)
+	}
+	if ts.token != "" && info.ModTime().Equal(ts.modTime) && info.Size() == ts.size {
+		return ts.token, nil
+	}
+
+	data, err := os.ReadFile(ts.path)
+	if err != nil {
+		return "", fmt.Errorf("error reading token: %v", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", ts.path)
+	}
+
+	if ts.token != "" && token != ts.token {
+		log.Infof("NetBox token in %s changed, using the new one", ts.path)
+	}
+	ts.token, ts.modTime, ts.size = token, info.ModTime(), info.Size()
+	return ts.token, nil
+}
+
+// runCommand runs the helper command once, its token is kept until it is invalidated
+func (ts *tokenSource) runCommand() (string, error) {
+	if ts.token != "" {
+		return ts.token, nil
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", ts.cfg.TokenCommand)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("error running token command: %v", err)
+	}
+	token := strings.TrimSpace(string(out))
+	if token == "" {
+		return "", fmt.Errorf("token command printed no token")
+	}
+
+	ts.token = token
+	return ts.token, nil
+}
+
+// invalidate makes the next get read the file or run the command again
+func (ts *tokenSource) invalidate() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.cfg.Token == "" {
+		ts.token = ""
+	}
+}
+
+// warnWorldReadable warns once per file if everybody on the host can read the token
+func warnWorldReadable(path string) {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm()&0o004 == 0 {
+		return
+	}
+	if _, warned := warnedTokenFiles.LoadOrStore(path, true); !warned {
+		log.Warnf("Token file %s is world-readable (%s), restrict it with chmod 600", path, info.Mode().Perm())
+	}
+}
+
+// tokenTransport sets the Authorization header of every request from the token source
+type tokenTransport struct {
+	source *tokenSource
+	next   http.RoundTripper
+}
+
+func (t tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.source.get()
+	if err != nil {
+		return nil, err
+	}
+
+	// A RoundTripper must not modify the request it was given
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", fmt.Sprintf("Token %s", token))
+
+	res, err := t.next.RoundTrip(req)
+	if err == nil && (res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden) {
+		t.source.invalidate()
+	}
+	return res, err
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/iglov/netbox-agent/lib/kubernetes"
+	"github.com/iglov/netbox-agent/lib/libvirt"
+	"github.com/iglov/netbox-agent/lib/proxmox"
+	"github.com/netbox-community/go-netbox/v4"
+)
+
+// guest is a hypervisor independent view of a virtual machine or container
+type guest struct {
+	Name       string
+	VCPUs      float64
+	MemoryMB   int64
+	Disks      []guestDisk
+	Interfaces []guestInterface
+	Status     netbox.PatchedWritableModuleRequestStatus
+	Context    interface{}
+}
+
+type guestDisk struct {
+	Name        string
+	SizeGB      int64
+	Description string
+}
+
+type guestInterface struct {
+	Name        string
+	MacAddress  string
+	Description string
+}
+
+// clusterMember returns the kind of the cluster the device is a member of, the first enabled and detected one
+// in collectors.cluster_precedence, or "" if there is none
+func (s *syncer) clusterMember() string {
+	collectors := s.cfg.Collectors
+	detected := map[string]bool{
+		"libvirt":    collectors.Libvirt.Enabled && libvirt.IsPresent(),
+		"proxmox":    collectors.Proxmox.Enabled && proxmox.IsPresent(),
+		"kubernetes": collectors.Kubernetes.Enabled && kubernetes.IsPresent(),
+	}
+	for _, kind := range collectors.ClusterPrecedence {
+		if detected[kind] {
+			return kind
+		}
+	}
+	return ""
+}
+
+// ensureCluster finds the cluster by name or creates it together with its type.
+// It returns nil if the cluster could not be found or created or belongs to another site than the device,
+// in dry run mode a cluster that doesn't exist yet is returned with id 0.
+func (s *syncer) ensureCluster(name, typeName, site string) *netbox.Cluster {
+	clusterRes, _, err := s.c.VirtualizationAPI.VirtualizationClustersList(s.ctx).Name([]string{name}).Execute()
+	if err != nil {
+		s.fail("virtualization.cluster", "Error listing clusters", err)
+		return nil
+	}
+	debugResponse(clusterRes)
+
+	if len(clusterRes.Results) > 0 {
+		cluster := &clusterRes.Results[0]
+		// NetBox refuses a device in a cluster of another site, a cluster without a site takes any device
+		if clusterSite := clusterSiteSlug(cluster); clusterSite != "" && clusterSite != slugify(site) {
+			log.Warnf("Cluster %s belongs to site %s, not to %s of the device, skipping it", name, clusterSite, site)
+			return nil
+		}
+		s.unchanged("virtualization.cluster", name)
+		return cluster
+	}
+
+	clusterType := netbox.NewClusterTypeRequestWithDefaults()
+	clusterType.SetName(typeName)
+	clusterType.SetSlug(slugify(typeName))
+
+	typeRes, _, err := s.c.VirtualizationAPI.VirtualizationClusterTypesList(s.ctx).Slug([]string{clusterType.Slug}).Execute()
+	if err != nil {
+		s.fail("virtualization.clustertype", "Error listing cluster types", err)
+		return nil
+	}
+	debugResponse(typeRes)
+
+	if len(typeRes.Results) == 0 && s.record("create", "virtualization.clustertype", typeName, nil) {
+		typeCreateRes, _, err := s.c.VirtualizationAPI.VirtualizationClusterTypesCreate(s.ctx).ClusterTypeRequest(*clusterType).Execute()
+		if err != nil {
+			s.fail("virtualization.clustertype", "Error creating cluster type", err)
+			return nil
+		}
+		debugResponse(typeCreateRes)
+	}
+
+	if !s.record("create", "virtualization.cluster", name, map[string]interface{}{"type": clusterType.Slug}) {
+		return &netbox.Cluster{Name: name}
+	}
+
+	cluster := netbox.NewWritableClusterRequestWithDefaults()
+	cluster.SetName(name)
+	cluster.SetType(*clusterType)
+	if site != "" {
+		cluster.SetSite(netbox.SiteRequest{Name: site, Slug: slugify(site)})
+	}
+
+	createRes, _, err := s.c.VirtualizationAPI.VirtualizationClustersCreate(s.ctx).WritableClusterRequest(*cluster).Execute()
+	if err != nil {
+		s.fail("virtualization.cluster", "Error creating cluster", err)
+		return nil
+	}
+	debugResponse(createRes)
+
+	return createRes
+}
+
+// clusterSiteSlug returns the slug of the site of the cluster, "" if it has none.
+// The site isn't part of the cluster model of the client, it is kept in its additional properties.
+func clusterSiteSlug(cluster *netbox.Cluster) string {
+	site, ok := cluster.AdditionalProperties["site"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	slug, _ := site["slug"].(string)
+	return slug
+}
+
+// assignDeviceToCluster makes the device a member of the cluster
+func (s *syncer) assignDeviceToCluster(deviceName string, cluster *netbox.Cluster) {
+	deviceRes, _, err := s.c.DcimAPI.DcimDevicesList(s.ctx).Name([]string{deviceName}).Execute()
+	if err != nil {
+		s.fail("dcim.device", "Error listing devices", err)
+		return
+	}
+	debugResponse(deviceRes)
+
+	if len(deviceRes.Results) == 0 {
+		// The device is only created when not in dry run mode
+		if !s.dryRun {
+			s.fail("dcim.device", "Error assigning device to cluster", fmt.Errorf("device %s not found", deviceName))
+		}
+		return
+	}
+
+	dev := deviceRes.Results[0]
+	if cl, ok := dev.GetClusterOk(); ok && cl != nil && cl.Id == cluster.Id {
+		s.unchanged("dcim.device", deviceName)
+		return
+	}
+	if !s.record("update", "dcim.device", deviceName, map[string]interface{}{"cluster": cluster.Name}) {
+		return
+	}
+
+	patch := netbox.NewPatchedWritableDeviceWithConfigContextRequestWithDefaults()
+	patch.SetCluster(netbox.ClusterRequest{Name: cluster.Name})
+
+	patchRes, _, err := s.c.DcimAPI.DcimDevicesPartialUpdate(s.ctx, dev.Id).PatchedWritableDeviceWithConfigContextRequest(*patch).Execute()
+	if err != nil {
+		s.fail("dcim.device", "Error assigning device to cluster", err)
+		return
+	}
+	debugResponse(patchRes)
+}
+
+// syncGuests upserts the guests as virtual machines of the cluster hosted on the device.
+// Virtual machines of the cluster hosted on the device that are no longer reported get retiredStatus,
+// unless they are listed in elsewhere (e.g. migrated to another cluster member).
+func (s *syncer) syncGuests(cluster *netbox.Cluster, deviceName string, guests []guest, elsewhere map[string]bool, retiredStatus netbox.PatchedWritableModuleRequestStatus) {
+	existing := map[string]netbox.VirtualMachineWithConfigContext{}
+
+	if cluster.Id != 0 {
+		vmRes, _, err := s.c.VirtualizationAPI.VirtualizationVirtualMachinesList(s.ctx).ClusterId([]*int32{&cluster.Id}).Limit(1000).Execute()
+		if err != nil {
+			s.fail("virtualization.virtualmachine", "Error listing virtual machines", err)
+			return
+		}
+		debugResponse(vmRes)
+
+		for _, vm := range vmRes.Results {
+			existing[vm.Name] = vm
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, g := range guests {
+		seen[g.Name] = true
+		vm, ok := existing[g.Name]
+		if !ok {
+			vm = s.createGuest(cluster, deviceName, g)
+		} else {
+			s.updateGuest(vm, cluster, deviceName, g)
+		}
+
+		s.syncGuestInterfaces(vm, g.Name, g.Interfaces)
+		s.syncGuestDisks(vm, g.Name, g.Disks)
+	}
+
+	for name, vm := range existing {
+		if seen[name] || elsewhere[name] {
+			continue
+		}
+		// Only retire guests this device was hosting
+		if dev, ok := vm.GetDeviceOk(); !ok || dev == nil || dev.GetName() != deviceName {
+			continue
+		}
+		if vm.Status.GetValue() == retiredStatus {
+			continue
+		}
+		if !s.record("update", "virtualization.virtualmachine", name, map[string]interface{}{"status": retiredStatus}) {
+			continue
+		}
+
+		patch := netbox.NewPatchedWritableVirtualMachineWithConfigContextRequestWithDefaults()
+		patch.SetStatus(retiredStatus)
+
+		patchRes, _, err := s.c.VirtualizationAPI.VirtualizationVirtualMachinesPartialUpdate(s.ctx, vm.Id).PatchedWritableVirtualMachineWithConfigContextRequest(*patch).Execute()
+		if err != nil {
+			s.fail("virtualization.virtualmachine", "Error updating virtual machine status", err)
+			continue
+		}
+
+		log.Infof("Virtual machine %s is no longer defined, status set to %s", name, retiredStatus)
+		debugResponse(patchRes)
+	}
+}
+
+func (s *syncer) createGuest(cluster *netbox.Cluster, deviceName string, g guest) netbox.VirtualMachineWithConfigContext {
+	if !s.record("create", "virtualization.virtualmachine", g.Name, map[string]interface{}{"cluster": cluster.Name, "status": g.Status}) {
+		return netbox.VirtualMachineWithConfigContext{}
+	}
+
+	vm := netbox.NewWritableVirtualMachineWithConfigContextRequestWithDefaults()
+	vm.SetName(g.Name)
+	vm.SetStatus(g.Status)
+	vm.SetCluster(netbox.ClusterRequest{Name: cluster.Name})
+	vm.SetDevice(netbox.DeviceRequest{Name: *netbox.NewNullableString(&deviceName)})
+	if g.VCPUs > 0 {
+		vm.SetVcpus(g.VCPUs)
+	}
+	vm.SetMemory(int32(g.MemoryMB))
+	vm.SetDisk(int32(totalDiskSize(g.Disks)))
+	if g.Context != nil {
+		vm.SetLocalContextData(g.Context)
+	}
+	vm.SetTags(s.ownerTags())
+
+	vmRes, _, err := s.c.VirtualizationAPI.VirtualizationVirtualMachinesCreate(s.ctx).WritableVirtualMachineWithConfigContextRequest(*vm).Execute()
+	if err != nil {
+		s.fail("virtualization.virtualmachine", "Error creating virtual machine", err)
+		return netbox.VirtualMachineWithConfigContext{}
+	}
+	debugResponse(vmRes)
+
+	return *vmRes
+}
+
+func (s *syncer) updateGuest(vm netbox.VirtualMachineWithConfigContext, cluster *netbox.Cluster, deviceName string, g guest) {
+	patch := netbox.NewPatchedWritableVirtualMachineWithConfigContextRequestWithDefaults()
+	fields := map[string]interface{}{}
+
+	if vm.Status.GetValue() != g.Status {
+		patch.SetStatus(g.Status)
+		fields["status"] = g.Status
+	}
+	if dev, ok := vm.GetDeviceOk(); !ok || dev == nil || dev.GetName() != deviceName {
+		patch.SetCluster(netbox.ClusterRequest{Name: cluster.Name})
+		patch.SetDevice(netbox.DeviceRequest{Name: *netbox.NewNullableString(&deviceName)})
+		fields["device"] = deviceName
+	}
+	if g.VCPUs > 0 && vm.GetVcpus() != g.VCPUs {
+		patch.SetVcpus(g.VCPUs)
+		fields["vcpus"] = g.VCPUs
+	}
+	if int64(vm.GetMemory()) != g.MemoryMB {
+		patch.SetMemory(int32(g.MemoryMB))
+		fields["memory"] = g.MemoryMB
+	}
+	if int64(vm.GetDisk()) != totalDiskSize(g.Disks) {
+		patch.SetDisk(int32(totalDiskSize(g.Disks)))
+		fields["disk"] = totalDiskSize(g.Disks)
+	}
+	if g.Context != nil && !jsonEqual(vm.LocalContextData, g.Context) {
+		patch.SetLocalContextData(g.Context)
+		fields["local_context_data"] = "(changed)"
+	}
+
+	if len(fields) == 0 {
+		s.unchanged("virtualization.virtualmachine", g.Name)
+		return
+	}
+	if !s.record("update", "virtualization.virtualmachine", g.Name, fields) {
+		return
+	}
+
+	vmRes, _, err := s.c.VirtualizationAPI.VirtualizationVirtualMachinesPartialUpdate(s.ctx, vm.Id).PatchedWritableVirtualMachineWithConfigContextRequest(*patch).Execute()
+	if err != nil {
+		s.fail("virtualization.virtualmachine", "Error updating virtual machine", err)
+		return
+	}
+	debugResponse(vmRes)
+}
+
+func (s *syncer) syncGuestInterfaces(vm netbox.VirtualMachineWithConfigContext, vmName string, interfaces []guestInterface) {
+	existing := map[string]netbox.VMInterface{}
+
+	if vm.Id != 0 {
+		ifRes, _, err := s.c.VirtualizationAPI.VirtualizationInterfacesList(s.ctx).VirtualMachineId([]int32{vm.Id}).Limit(1000).Execute()
+		if err != nil {
+			s.fail("virtualization.vminterface", "Error listing virtual machine interfaces", err)
+			return
+		}
+		debugResponse(ifRes)
+
+		for _, iface := range ifRes.Results {
+			existing[iface.Name] = iface
+		}
+	}
+
+	for _, iface := range interfaces {
+		if known, ok := existing[iface.Name]; ok {
+			if known.GetMacAddress() == iface.MacAddress && known.GetDescription() == iface.Description {
+				s.unchanged("virtualization.vminterface", vmName+"/"+iface.Name)
+				continue
+			}
+			if !s.record("update", "virtualization.vminterface", vmName+"/"+iface.Name, map[string]interface{}{"mac_address": iface.MacAddress, "description": iface.Description}) {
+				continue
+			}
+
+			patch := netbox.NewPatchedWritableVMInterfaceRequestWithDefaults()
+			patch.SetMacAddress(iface.MacAddress)
+			patch.SetDescription(iface.Description)
+
+			patchRes, _, err := s.c.VirtualizationAPI.VirtualizationInterfacesPartialUpdate(s.ctx, known.Id).PatchedWritableVMInterfaceRequest(*patch).Execute()
+			if err != nil {
+				s.fail("virtualization.vminterface", "Error updating virtual machine interface", err)
+				continue
+			}
+			debugResponse(patchRes)
+			continue
+		}
+
+		if !s.record("create", "virtualization.vminterface", vmName+"/"+iface.Name, map[string]interface{}{"mac_address": iface.MacAddress}) || vm.Id == 0 {
+			continue
+		}
+
+		netInt := netbox.NewWritableVMInterfaceRequestWithDefaults()
+		netInt.SetVirtualMachine(netbox.VirtualMachineRequest{Name: vm.Name})
+		netInt.SetName(iface.Name)
+		if iface.MacAddress != "" {
+			netInt.SetMacAddress(iface.MacAddress)
+		}
+		netInt.SetDescription(iface.Description)
+
+		netIntRes, _, err := s.c.VirtualizationAPI.VirtualizationInterfacesCreate(s.ctx).WritableVMInterfaceRequest(*netInt).Execute()
+		if err != nil {
+			s.fail("virtualization.vminterface", "Error creating virtual machine interface", err)
+			continue
+		}
+		debugResponse(netIntRes)
+	}
+}
+
+func (s *syncer) syncGuestDisks(vm netbox.VirtualMachineWithConfigContext, vmName string, disks []guestDisk) {
+	existing := map[string]netbox.VirtualDisk{}
+
+	if vm.Id != 0 {
+		diskRes, _, err := s.c.VirtualizationAPI.VirtualizationVirtualDisksList(s.ctx).VirtualMachineId([]int32{vm.Id}).Limit(1000).Execute()
+		if err != nil {
+			s.fail("virtualization.virtualdisk", "Error listing virtual disks", err)
+			return
+		}
+		debugResponse(diskRes)
+
+		for _, disk := range diskRes.Results {
+			existing[disk.Name] = disk
+		}
+	}
+
+	for _, disk := range disks {
+		if known, ok := existing[disk.Name]; ok {
+			if int64(known.Size) == disk.SizeGB && known.GetDescription() == disk.Description {
+				s.unchanged("virtualization.virtualdisk", vmName+"/"+disk.Name)
+				continue
+			}
+			if !s.record("update", "virtualization.virtualdisk", vmName+"/"+disk.Name, map[string]interface{}{"size": disk.SizeGB, "description": disk.Description}) {
+				continue
+			}
+
+			patch := netbox.NewPatchedVirtualDiskRequestWithDefaults()
+			patch.SetSize(int32(disk.SizeGB))
+			patch.SetDescription(disk.Description)
+
+			patchRes, _, err := s.c.VirtualizationAPI.VirtualizationVirtualDisksPartialUpdate(s.ctx, known.Id).PatchedVirtualDiskRequest(*patch).Execute()
+			if err != nil {
+				s.fail("virtualization.virtualdisk", "Error updating virtual disk", err)
+				continue
+			}
+			debugResponse(patchRes)
+			continue
+		}
+
+		if !s.record("create", "virtualization.virtualdisk", vmName+"/"+disk.Name, map[string]interface{}{"size": disk.SizeGB}) || vm.Id == 0 {
+			continue
+		}
+
+		vd := netbox.NewVirtualDiskRequestWithDefaults()
+		vd.SetVirtualMachine(netbox.VirtualMachineRequest{Name: vm.Name})
+		vd.SetName(disk.Name)
+		vd.SetSize(int32(disk.SizeGB))
+		vd.SetDescription(disk.Description)
+
+		vdRes, _, err := s.c.VirtualizationAPI.VirtualizationVirtualDisksCreate(s.ctx).VirtualDiskRequest(*vd).Execute()
+		if err != nil {
+			s.fail("virtualization.virtualdisk", "Error creating virtual disk", err)
+			continue
+		}
+		debugResponse(vdRes)
+	}
+}
+
+func totalDiskSize(disks []guestDisk) int64 {
+	var total int64
+	for _, disk := range disks {
+		total += disk.SizeGB
+	}
+	return total
+}